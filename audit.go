@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/rspamd-classes/classes"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// append-only JSON lines log, reopened when the configured path changes or
+// on the reopen signal after rotation
+type jsonLog struct {
+	label string
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+func (l *jsonLog) Write(path string, entry any) {
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("%s: failed formatting entry: %v\n", l.label, err)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil || l.path != path {
+		if l.file != nil {
+			l.file.Close()
+			l.file = nil
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Printf("%s: failed opening %s: %v\n", l.label, path, err)
+			return
+		}
+		l.file = file
+		l.path = path
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("%s: failed writing %s: %v\n", l.label, path, err)
+	}
+}
+
+// close the log file so the next write reopens its path
+func (l *jsonLog) Reopen() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// a state change made by a mutating request
+type AuditEntry struct {
+	Time      time.Time
+	RequestId string `json:",omitempty"`
+	ClientCN  string `json:",omitempty"`
+	ApiKey    string `json:",omitempty"`
+	User      string
+	Operation string
+	Before    any
+	After     any
+	Diff      []string
+}
+
+var audit = jsonLog{label: "audit"}
+
+func auditEnabled(w http.ResponseWriter) bool {
+	return requestConfig(w).AuditLog != ""
+}
+
+func writeAudit(w http.ResponseWriter, user, operation string, before, after any, diff []string) {
+	entry := AuditEntry{
+		Time:      time.Now(),
+		User:      user,
+		Operation: operation,
+		Before:    before,
+		After:     after,
+		Diff:      diff,
+	}
+	if rw, ok := requestState(w); ok {
+		entry.RequestId = rw.id
+		entry.ClientCN = rw.dn
+		if rw.apiKey != nil {
+			entry.ApiKey = rw.apiKey.Name
+		}
+	}
+	audit.Write(requestConfig(w).AuditLog, &entry)
+}
+
+// return a copy of the user's own class set, or nil if the user has none
+func userClasses(config *classes.SpamClasses, user string) []classes.SpamClass {
+	spamClasses, ok := config.Classes[user]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(spamClasses)
+}
+
+func auditClasses(w http.ResponseWriter, user, operation string, before, after []classes.SpamClass) {
+	if !auditEnabled(w) {
+		return
+	}
+	writeAudit(w, user, operation, before, after, classesDiff(before, after))
+}
+
+func classesDiff(before, after []classes.SpamClass) []string {
+	diff := []string{}
+	old := make(map[string]float32, len(before))
+	for _, class := range before {
+		old[class.Name] = class.Score
+	}
+	for _, class := range after {
+		score, ok := old[class.Name]
+		switch {
+		case !ok:
+			diff = append(diff, fmt.Sprintf("+%s=%v", class.Name, class.Score))
+		case score != class.Score:
+			diff = append(diff, fmt.Sprintf("~%s=%v->%v", class.Name, score, class.Score))
+		}
+		delete(old, class.Name)
+	}
+	for _, class := range before {
+		if _, ok := old[class.Name]; ok {
+			diff = append(diff, fmt.Sprintf("-%s=%v", class.Name, class.Score))
+		}
+	}
+	return diff
+}
+
+// return the user's books for the audit log; nil when auditing is disabled
+func auditUserBooks(w http.ResponseWriter, mab *api.Controller, user string) map[string][]string {
+	if !auditEnabled(w) {
+		return nil
+	}
+	start := time.Now()
+	response, err := mab.Dump(user)
+	observeMAB(w, "Dump", start, err)
+	if err != nil {
+		logf(w, "audit: failed reading books for %s: %v\n", user, err)
+		return nil
+	}
+	books := response.Dump.Users[user].Books
+	if books == nil {
+		books = map[string][]string{}
+	}
+	return books
+}
+
+// return the addresses of the named books for the audit log, omitting books
+// the user does not have; nil when auditing is disabled
+func auditBookAddresses(w http.ResponseWriter, mab *api.Controller, user string, books ...string) map[string][]string {
+	if !auditEnabled(w) {
+		return nil
+	}
+	start := time.Now()
+	response, err := mab.GetBooks(user)
+	observeMAB(w, "GetBooks", start, err)
+	if err != nil {
+		logf(w, "audit: failed reading books for %s: %v\n", user, err)
+		return nil
+	}
+	addresses := map[string][]string{}
+	for _, book := range response.Books {
+		if !slices.Contains(books, book.BookName) {
+			continue
+		}
+		start = time.Now()
+		bookResponse, err := mab.Addresses(nil, user, book.BookName)
+		observeMAB(w, "Addresses", start, err)
+		if err != nil {
+			logf(w, "audit: failed reading %s addresses for %s: %v\n", book.BookName, user, err)
+			return nil
+		}
+		addresses[book.BookName] = bookResponse.Addresses
+	}
+	return addresses
+}
+
+func auditBooks(w http.ResponseWriter, user, operation string, before, after map[string][]string) {
+	if !auditEnabled(w) {
+		return
+	}
+	writeAudit(w, user, operation, before, after, booksDiff(before, after))
+}
+
+func booksDiff(before, after map[string][]string) []string {
+	diff := []string{}
+	for _, book := range sortedKeys(after) {
+		old, ok := before[book]
+		if !ok {
+			diff = append(diff, "+"+book)
+		}
+		for _, address := range after[book] {
+			if !slices.Contains(old, address) {
+				diff = append(diff, fmt.Sprintf("+%s/%s", book, address))
+			}
+		}
+	}
+	for _, book := range sortedKeys(before) {
+		current, ok := after[book]
+		for _, address := range before[book] {
+			if !slices.Contains(current, address) {
+				diff = append(diff, fmt.Sprintf("-%s/%s", book, address))
+			}
+		}
+		if !ok {
+			diff = append(diff, "-"+book)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before := []classes.SpamClass{{Name: "ham", Score: 0}, {Name: "possible", Score: 5}, {Name: "spam", Score: 999}}
+	after := []classes.SpamClass{{Name: "ham", Score: 0}, {Name: "possible", Score: 7}, {Name: "probable", Score: 10}}
+	require.Equal(t, []string{"~possible=5->7", "+probable=10", "-spam=999"}, classesDiff(before, after))
+	require.Equal(t, []string{}, classesDiff(before, before))
+
+	books := map[string][]string{"friends": {"a@example.org"}, "work": {"b@example.org"}}
+	changed := map[string][]string{"friends": {"a@example.org", "c@example.org"}, "family": {}}
+	require.Equal(t, []string{"+family", "+friends/c@example.org", "-work/b@example.org", "-work"}, booksDiff(books, changed))
+}
+
+func TestAuditLog(t *testing.T) {
+	Initialize(t)
+	defer activeConfig.Store(nil)
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	activeConfig.Store(&ServerConfig{AuditLog: auditFile})
+
+	rw := &requestWriter{ResponseWriter: httptest.NewRecorder(), id: "req1", dn: "client", apiKey: &ApiKey{Name: "admin"}}
+	before := []classes.SpamClass{{Name: "spam", Score: 999}}
+	auditClasses(rw, "alice@example.org", "delete user", before, nil)
+
+	file, err := os.Open(auditFile)
+	require.Nil(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	require.True(t, scanner.Scan())
+	var entry AuditEntry
+	err = json.Unmarshal(scanner.Bytes(), &entry)
+	require.Nil(t, err)
+	require.Equal(t, "req1", entry.RequestId)
+	require.Equal(t, "client", entry.ClientCN)
+	require.Equal(t, "admin", entry.ApiKey)
+	require.Equal(t, "alice@example.org", entry.User)
+	require.Equal(t, "delete user", entry.Operation)
+	require.Equal(t, []string{"-spam=999"}, entry.Diff)
+	require.False(t, scanner.Scan())
+}
+
+func TestAuditReopen(t *testing.T) {
+	dir := t.TempDir()
+	auditFile := filepath.Join(dir, "audit.log")
+	log := jsonLog{label: "test"}
+	log.Write(auditFile, "first")
+	require.Nil(t, os.Rename(auditFile, filepath.Join(dir, "audit.log.0")))
+
+	// writes follow the open file until reopened
+	log.Write(auditFile, "second")
+	_, err := os.Stat(auditFile)
+	require.True(t, os.IsNotExist(err))
+
+	log.Reopen()
+	log.Write(auditFile, "third")
+	data, err := os.ReadFile(auditFile)
+	require.Nil(t, err)
+	require.Equal(t, "\"third\"\n", string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "audit.log.0"))
+	require.Nil(t, err)
+	require.Equal(t, "\"first\"\n\"second\"\n", string(data))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/rspamd-classes/classes"
+	"math"
+	"net/http"
+)
+
+type ClassifyItem struct {
+	Addresses []string
+	Score     float32
+}
+
+// the class a recipient would receive on its own
+type RecipientClass struct {
+	Address string
+	Custom  bool
+	Class   string
+}
+
+// DecidedBy is the recipient whose class set determined Class, or "default"
+// when no recipient has custom classes.
+type ClassifyResult struct {
+	Addresses  []string
+	Score      float32
+	Class      string
+	DecidedBy  string
+	Default    bool
+	Recipients []RecipientClass
+}
+
+type ClassifyResponse struct {
+	api.Response
+	Results []ClassifyResult
+}
+
+// report whether score is finite; NaN and infinities match no class range
+func validScore(score float64) bool {
+	return !math.IsNaN(score) && !math.IsInf(score, 0)
+}
+
+// return the class for score using the first address with configured classes
+func classify(config *classes.SpamClasses, addresses []string, score float32) ClassifyResult {
+	result := ClassifyResult{
+		Addresses:  addresses,
+		Score:      score,
+		Class:      config.GetClass(addresses, score),
+		DecidedBy:  classes.DEFAULT_NAME,
+		Default:    true,
+		Recipients: make([]RecipientClass, len(addresses)),
+	}
+	for i, address := range addresses {
+		// matches the selection in SpamClasses.GetClass
+		custom := len(config.Classes[address]) > 0
+		if custom && result.Default {
+			result.DecidedBy = address
+			result.Default = false
+		}
+		result.Recipients[i] = RecipientClass{
+			Address: address,
+			Custom:  custom,
+			Class:   config.GetClass([]string{address}, score),
+		}
+	}
+	return result
+}
+
+func handlePostClassify(w http.ResponseWriter, r *http.Request) {
+	var items []ClassifyItem
+	err := json.NewDecoder(r.Body).Decode(&items)
+	if err != nil {
+		fail(w, "system", "classify", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	requestString := fmt.Sprintf("classify %d items", len(items))
+	if isVerbose(w) {
+		logf(w, "Classify: items=%+v\n", items)
+	}
+	for _, item := range items {
+		if !validScore(float64(item.Score)) {
+			fail(w, "system", requestString, fmt.Sprintf("invalid score: %v", item.Score), http.StatusBadRequest)
+			return
+		}
+		for _, address := range item.Addresses {
+			if !checkUser(w, "post_classify", address) {
+				return
+			}
+		}
+	}
+	config, ok := readCachedConfig(w, "system", requestString)
+	if !ok {
+		return
+	}
+	var response ClassifyResponse
+	response.User = "system"
+	response.Request = requestString
+	response.Success = true
+	response.Results = make([]ClassifyResult, len(items))
+	for i, item := range items {
+		response.Results[i] = classify(config, item.Addresses, item.Score)
+	}
+	response.Message = fmt.Sprintf("classified %d items", len(items))
+	succeed(w, response.Message, &response)
+}
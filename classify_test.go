@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	items := []ClassifyItem{
+		{Addresses: []string{"alice@example.org"}, Score: 7},
+		{Addresses: []string{"bob@example.org", "alice@example.org"}, Score: 7},
+		{Addresses: []string{"bob@example.org"}, Score: 7},
+		{Addresses: []string{}, Score: 20},
+	}
+	req := httptest.NewRequest("POST", "/filterctl/classify/", requestBuffer(t, &items))
+	result := callHandler("POST /filterctl/classify/", handlePostClassify, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response ClassifyResponse
+	err := json.NewDecoder(result.Body).Decode(&response)
+	require.Nil(t, err)
+	require.True(t, response.Success)
+	classes := []string{}
+	for _, result := range response.Results {
+		classes = append(classes, result.Class)
+	}
+	require.Equal(t, []string{"ham", "ham", "probable", "spam"}, classes)
+}
+
+func TestGetClassRecipients(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	req := httptest.NewRequest("GET", "/filterctl/class/bob@example.org/7/?address=alice@example.org&address=carol@example.org", nil)
+	result := callHandler("GET /filterctl/class/{address}/{score}/", handleGetClass, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response ClassResponse
+	err := json.NewDecoder(result.Body).Decode(&response)
+	require.Nil(t, err)
+	require.Equal(t, "ham", response.Class)
+	require.Equal(t, "alice@example.org", response.DecidedBy)
+	require.False(t, response.Default)
+	require.Len(t, response.Recipients, 3)
+	require.Equal(t, RecipientClass{Address: "bob@example.org", Custom: false, Class: "probable"}, response.Recipients[0])
+	require.Equal(t, RecipientClass{Address: "alice@example.org", Custom: true, Class: "ham"}, response.Recipients[1])
+
+	req = httptest.NewRequest("GET", "/filterctl/class/bob@example.org/7/", nil)
+	result = callHandler("GET /filterctl/class/{address}/{score}/", handleGetClass, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	response = ClassResponse{}
+	err = json.NewDecoder(result.Body).Decode(&response)
+	require.Nil(t, err)
+	require.Equal(t, "probable", response.Class)
+	require.Equal(t, "default", response.DecidedBy)
+	require.True(t, response.Default)
+}
+
+func TestInvalidScore(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	for _, score := range []string{"NaN", "Inf", "-Inf", "1e39", "high"} {
+		req := httptest.NewRequest("GET", "/filterctl/class/bob@example.org/"+score+"/", nil)
+		result := callHandler("GET /filterctl/class/{address}/{score}/", handleGetClass, req)
+		require.Equal(t, http.StatusBadRequest, result.StatusCode, score)
+	}
+	require.True(t, validScore(-5))
+	require.False(t, validScore(math.NaN()))
+	require.False(t, validScore(math.Inf(-1)))
+}
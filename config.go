@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultViperConfigFile = "/etc/filterctld/config.yaml"
+
+// endpoints that may be called by a client certificate DN
+//
+// DN is CN=<common name>; other RDNs of the certificate subject are not
+// compared, and a configured full DN is reduced to its CN when loaded.  Each entry in Endpoints is an endpoint name (as passed to
+// checkClientCert), an HTTP method such as GET, * for all endpoints, or debug
+// for the debug_ endpoints.  Debug endpoints also need an api key granting
+// them by name or debug; see checkDebug.
+type ClientCertPolicy struct {
+	DN        string
+	Endpoints []string
+}
+
+var defaultClientCerts = []ClientCertPolicy{
+	{DN: "CN=filterctl", Endpoints: []string{"*"}},
+	{DN: "CN=mabctl", Endpoints: []string{"*"}},
+	{DN: "CN=filterbooks", Endpoints: []string{"list_books", "add_book", "delete_book", "list_addresses", "add_address", "delete_address"}},
+}
+
+// a named X-Api-Key value with optional scope restrictions
+//
+// Endpoints uses the same syntax as ClientCertPolicy.  An empty Users list
+// allows any user; a zero Expires never expires.  The legacy api_key setting
+// is loaded as a key named "default" with access to all endpoints.
+type ApiKey struct {
+	Name      string
+	Key       string
+	Expires   time.Time
+	Endpoints []string
+	Users     []string
+}
+
+func (k *ApiKey) Permits(endpoint, method string) bool {
+	return permits(k.Endpoints, endpoint, method)
+}
+
+func (k *ApiKey) PermitsUser(user string) bool {
+	return len(k.Users) == 0 || slices.Contains(k.Users, user)
+}
+
+func (k *ApiKey) Expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+func (k ApiKey) String() string {
+	return fmt.Sprintf("%s:[%s]", k.Name, strings.Join(k.Endpoints, ","))
+}
+
+// settings that may be replaced at runtime by a reload
+type ServerConfig struct {
+	ApiKeys             []ApiKey
+	ClientCerts         []ClientCertPolicy
+	TrustedProxies      []netip.Prefix
+	UniqueBookAddresses bool
+	Scan                *ScanConfig
+	AuditLog            string
+	DebugEndpoints      bool
+	LogRotate           *LogRotateConfig
+	Stats               *StatsConfig
+	Peers               []PeerPolicy
+}
+
+// return the policy for a client certificate DN
+func (c *ServerConfig) ClientCert(dn string) (*ClientCertPolicy, bool) {
+	for i := range c.ClientCerts {
+		if c.ClientCerts[i].DN == dn {
+			return &c.ClientCerts[i], true
+		}
+	}
+	return nil, false
+}
+
+func (p *ClientCertPolicy) Permits(endpoint, method string) bool {
+	return permits(p.Endpoints, endpoint, method)
+}
+
+func permits(endpoints []string, endpoint, method string) bool {
+	for _, allowed := range endpoints {
+		if allowed == "*" || allowed == endpoint || allowed == method {
+			return true
+		}
+		if allowed == "debug" && strings.HasPrefix(endpoint, "debug_") {
+			return true
+		}
+	}
+	return false
+}
+
+// return the key matching value; every key is compared so the timing does not depend on which one matched
+func (c *ServerConfig) MatchApiKey(value string) (*ApiKey, bool) {
+	match := -1
+	for i := range c.ApiKeys {
+		if subtle.ConstantTimeCompare([]byte(c.ApiKeys[i].Key), []byte(value)) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, false
+	}
+	return &c.ApiKeys[match], true
+}
+
+func (p ClientCertPolicy) String() string {
+	return fmt.Sprintf("%s:[%s]", p.DN, strings.Join(p.Endpoints, ","))
+}
+
+func defaultClientCertsConfig() []map[string]any {
+	certs := make([]map[string]any, len(defaultClientCerts))
+	for i, cert := range defaultClientCerts {
+		certs[i] = map[string]any{"dn": cert.DN, "endpoints": cert.Endpoints}
+	}
+	return certs
+}
+
+var activeConfig atomic.Pointer[ServerConfig]
+
+func newServerConfig(v *viper.Viper) (*ServerConfig, error) {
+	config := ServerConfig{
+		UniqueBookAddresses: v.GetBool("unique_book_addresses"),
+		AuditLog:            v.GetString("audit_log"),
+		DebugEndpoints:      v.GetBool("debug_endpoints"),
+	}
+	err := v.UnmarshalKey("api_keys", &config.ApiKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing api_keys: %v", err)
+	}
+	if v.GetString("api_key") != "" {
+		config.ApiKeys = append([]ApiKey{{Name: "default", Key: v.GetString("api_key"), Endpoints: []string{"*"}}}, config.ApiKeys...)
+	}
+	if len(config.ApiKeys) == 0 && !InsecureSkipClientCertificateValidation {
+		return nil, fmt.Errorf("neither api_key nor api_keys is set")
+	}
+	names := make(map[string]bool, len(config.ApiKeys))
+	for _, key := range config.ApiKeys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("api_keys: missing name")
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("api_keys: duplicate name '%s'", key.Name)
+		}
+		names[key.Name] = true
+		if key.Key == "" {
+			return nil, fmt.Errorf("api_keys: %s has no key", key.Name)
+		}
+		if len(key.Endpoints) == 0 {
+			return nil, fmt.Errorf("api_keys: %s has no endpoints", key.Name)
+		}
+	}
+	err = v.UnmarshalKey("client_certs", &config.ClientCerts)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing client_certs: %v", err)
+	}
+	if len(config.ClientCerts) == 0 {
+		return nil, fmt.Errorf("client_certs is empty")
+	}
+	for i := range config.ClientCerts {
+		cert := &config.ClientCerts[i]
+		if cert.DN == "" {
+			return nil, fmt.Errorf("client_certs: missing dn")
+		}
+		cert.DN, err = configuredDN(cert.DN)
+		if err != nil {
+			return nil, fmt.Errorf("client_certs: %v", err)
+		}
+		if len(cert.Endpoints) == 0 {
+			return nil, fmt.Errorf("client_certs: %s has no endpoints", cert.DN)
+		}
+	}
+	config.TrustedProxies, err = parseTrustedProxies(v.GetStringSlice("trusted_proxies"))
+	if err != nil {
+		return nil, err
+	}
+	config.Scan, err = newScanConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	config.LogRotate, err = newLogRotateConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	config.Stats, err = newStatsConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	config.Peers, err = newPeerPolicies(v)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// return the active server config, initializing it from viper if necessary
+func currentConfig() *ServerConfig {
+	config := activeConfig.Load()
+	if config != nil {
+		return config
+	}
+	config, err := newServerConfig(viper.GetViper())
+	if err != nil {
+		log.Printf("WARNING: %v\n", err)
+		proxies, _ := parseTrustedProxies(defaultTrustedProxies)
+		config = &ServerConfig{
+			ClientCerts:         defaultClientCerts,
+			TrustedProxies:      proxies,
+			UniqueBookAddresses: viper.GetBool("unique_book_addresses"),
+			Scan:                &ScanConfig{Auth: ScanAuthNone},
+			LogRotate:           &LogRotateConfig{},
+			Stats:               &StatsConfig{Interval: defaultStatsInterval, MaxUsers: defaultStatsMaxUsers},
+		}
+	}
+	activeConfig.CompareAndSwap(nil, config)
+	return activeConfig.Load()
+}
+
+// re-read the viper config file; on failure the active config is unchanged
+//
+// Only ServerConfig is reloaded.  The global viper instance, read by the
+// mabctl api on the request path, is left as loaded at startup since
+// replacing it would race with those readers; address book settings need a
+// restart.
+func reloadConfig() error {
+	filename := viper.ConfigFileUsed()
+	if filename == "" {
+		filename = defaultViperConfigFile
+	}
+	v := viper.New()
+	v.SetConfigFile(filename)
+	err := v.ReadInConfig()
+	if err != nil {
+		return fmt.Errorf("failed reading %s: %v", filename, err)
+	}
+	setDefaults(v)
+	config, err := newServerConfig(v)
+	if err != nil {
+		return fmt.Errorf("rejected %s: %v", filename, err)
+	}
+
+	if old := activeConfig.Load(); old != nil {
+		config.Scan.inheritLimiter(old.Scan)
+	}
+	old := activeConfig.Swap(config)
+	classStats.SetLimit(config.Stats.MaxUsers)
+	for _, change := range configChanges(old, config) {
+		log.Printf("reload: %s\n", change)
+	}
+	log.Printf("reloaded %s\n", filename)
+	return nil
+}
+
+func configChanges(old, new *ServerConfig) []string {
+	if old == nil {
+		return []string{"initial config loaded"}
+	}
+	changes := []string{}
+	if len(old.ApiKeys) != len(new.ApiKeys) {
+		changes = append(changes, fmt.Sprintf("api_keys changed: %v -> %v", old.ApiKeys, new.ApiKeys))
+	} else {
+		for i := range old.ApiKeys {
+			if old.ApiKeys[i].Key != new.ApiKeys[i].Key {
+				changes = append(changes, fmt.Sprintf("api key %s rotated", new.ApiKeys[i].Name))
+			}
+			if fmt.Sprint(old.ApiKeys[i], old.ApiKeys[i].Expires, old.ApiKeys[i].Users) != fmt.Sprint(new.ApiKeys[i], new.ApiKeys[i].Expires, new.ApiKeys[i].Users) {
+				changes = append(changes, fmt.Sprintf("api key %s changed: %v -> %v", new.ApiKeys[i].Name, old.ApiKeys[i], new.ApiKeys[i]))
+			}
+		}
+	}
+	if fmt.Sprint(old.ClientCerts) != fmt.Sprint(new.ClientCerts) {
+		changes = append(changes, fmt.Sprintf("client_certs changed: %v -> %v", old.ClientCerts, new.ClientCerts))
+	}
+	if fmt.Sprint(old.TrustedProxies) != fmt.Sprint(new.TrustedProxies) {
+		changes = append(changes, fmt.Sprintf("trusted_proxies changed: %v -> %v", old.TrustedProxies, new.TrustedProxies))
+	}
+	if old.Scan.String() != new.Scan.String() || old.Scan.Secret != new.Scan.Secret {
+		changes = append(changes, fmt.Sprintf("scan changed: %v -> %v", old.Scan, new.Scan))
+	}
+	if old.AuditLog != new.AuditLog {
+		changes = append(changes, fmt.Sprintf("audit_log changed: '%s' -> '%s'", old.AuditLog, new.AuditLog))
+	}
+	if old.DebugEndpoints != new.DebugEndpoints {
+		changes = append(changes, fmt.Sprintf("debug_endpoints changed: %v -> %v", old.DebugEndpoints, new.DebugEndpoints))
+	}
+	if fmt.Sprint(old.LogRotate) != fmt.Sprint(new.LogRotate) {
+		changes = append(changes, fmt.Sprintf("log_rotate changed: %v -> %v", old.LogRotate, new.LogRotate))
+	}
+	if fmt.Sprint(old.Stats) != fmt.Sprint(new.Stats) {
+		changes = append(changes, fmt.Sprintf("stats changed: %v -> %v", old.Stats, new.Stats))
+	}
+	if fmt.Sprint(old.Peers) != fmt.Sprint(new.Peers) {
+		changes = append(changes, fmt.Sprintf("unix_socket.peers changed: %v -> %v", old.Peers, new.Peers))
+	}
+	if old.UniqueBookAddresses != new.UniqueBookAddresses {
+		changes = append(changes, fmt.Sprintf("unique_book_addresses changed: %v -> %v", old.UniqueBookAddresses, new.UniqueBookAddresses))
+	}
+	if len(changes) == 0 {
+		changes = append(changes, "no changes")
+	}
+	return changes
+}
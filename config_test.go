@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeViperConfig(t *testing.T, filename, content string) {
+	err := os.WriteFile(filename, []byte(content), 0600)
+	require.Nil(t, err)
+}
+
+func TestReloadConfig(t *testing.T) {
+	Initialize(t)
+	defer viper.SetConfigFile("./testdata/config.yaml")
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+
+	globalKey := viper.GetString("api_key")
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeViperConfig(t, filename, "api_key: first\nscan:\n  auth: none\n")
+	viper.SetConfigFile(filename)
+	activeConfig.Store(nil)
+	require.Nil(t, reloadConfig())
+	require.Equal(t, "first", currentConfig().ApiKeys[0].Key)
+	require.Equal(t, defaultClientCerts, currentConfig().ClientCerts)
+	require.True(t, currentConfig().UniqueBookAddresses)
+
+	writeViperConfig(t, filename, "api_key: second\nscan:\n  auth: none\nunique_book_addresses: false\nclient_certs:\n  - dn: CN=filterctl\n    endpoints: [GET]\n")
+	require.Nil(t, reloadConfig())
+	require.Equal(t, "second", currentConfig().ApiKeys[0].Key)
+	require.Equal(t, []ClientCertPolicy{{DN: "CN=filterctl", Endpoints: []string{"GET"}}}, currentConfig().ClientCerts)
+	require.False(t, currentConfig().UniqueBookAddresses)
+	// the global viper read by the mabctl api is not replaced under it
+	require.Equal(t, globalKey, viper.GetString("api_key"))
+
+	writeViperConfig(t, filename, "api_key: [unterminated\n")
+	require.NotNil(t, reloadConfig())
+	require.Equal(t, "second", currentConfig().ApiKeys[0].Key)
+
+	writeViperConfig(t, filename, "unique_book_addresses: true\n")
+	require.NotNil(t, reloadConfig())
+	require.Equal(t, "second", currentConfig().ApiKeys[0].Key)
+	require.False(t, currentConfig().UniqueBookAddresses)
+	activeConfig.Store(nil)
+}
+
+func certRequest(method, dn, apiKey string) *http.Request {
+	req := httptest.NewRequest(method, "/filterctl/test/", nil)
+	req.Header.Set("X-Client-Cert-Dn", dn)
+	req.Header.Set("X-Api-Key", apiKey)
+	req.RemoteAddr = "127.0.0.1:40000"
+	return req
+}
+
+func TestClientCertPolicy(t *testing.T) {
+	Initialize(t)
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+	proxies, err := parseTrustedProxies(defaultTrustedProxies)
+	require.Nil(t, err)
+	activeConfig.Store(&ServerConfig{ApiKeys: []ApiKey{{Name: "default", Key: "testkey", Endpoints: []string{"*"}}}, ClientCerts: defaultClientCerts, TrustedProxies: proxies})
+	defer activeConfig.Store(nil)
+
+	w := httptest.NewRecorder()
+	require.True(t, checkClientCert(w, certRequest("GET", "CN=filterbooks", "testkey"), "list_books"))
+
+	w = httptest.NewRecorder()
+	require.False(t, checkClientCert(w, certRequest("GET", "CN=filterbooks", "testkey"), "get_password"))
+	result := w.Result()
+	require.Equal(t, http.StatusForbidden, result.StatusCode)
+	var response api.Response
+	err = json.NewDecoder(result.Body).Decode(&response)
+	require.Nil(t, err)
+	require.False(t, response.Success)
+	require.Equal(t, "get_password", response.Request)
+
+	w = httptest.NewRecorder()
+	require.False(t, checkClientCert(w, certRequest("POST", "CN=unknown", "testkey"), "post_restore"))
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	require.True(t, checkClientCert(w, certRequest("POST", "CN=filterctl", "testkey"), "post_restore"))
+}
+
+func TestScopedApiKeys(t *testing.T) {
+	Initialize(t)
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+	defer activeConfig.Store(nil)
+
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeViperConfig(t, filename, `
+api_key: adminkey
+api_keys:
+  - name: webmail
+    key: webmailkey
+    endpoints: [list_books, get_class]
+    users: [alice@example.org]
+  - name: retired
+    key: retiredkey
+    expires: 2020-01-01T00:00:00Z
+    endpoints: ["*"]
+scan:
+  auth: none
+`)
+	v := viper.New()
+	v.SetConfigFile(filename)
+	require.Nil(t, v.ReadInConfig())
+	setDefaults(v)
+	config, err := newServerConfig(v)
+	require.Nil(t, err)
+	require.Len(t, config.ApiKeys, 3)
+	require.Equal(t, "default", config.ApiKeys[0].Name)
+	activeConfig.Store(config)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /filterctl/books/{user}/", func(w http.ResponseWriter, r *http.Request) {
+		if checkClientCert(&requestWriter{ResponseWriter: w}, r, "list_books", "user") {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	mux.HandleFunc("GET /filterctl/passwd/{user}/", func(w http.ResponseWriter, r *http.Request) {
+		if checkClientCert(&requestWriter{ResponseWriter: w}, r, "get_password", "user") {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	status := func(path, key string) int {
+		req := certRequest("GET", "CN=filterctl", key)
+		req.URL.Path = path
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	require.Equal(t, http.StatusOK, status("/filterctl/books/alice@example.org/", "webmailkey"))
+	require.Equal(t, http.StatusForbidden, status("/filterctl/books/bob@example.org/", "webmailkey"))
+	require.Equal(t, http.StatusForbidden, status("/filterctl/passwd/alice@example.org/", "webmailkey"))
+	require.Equal(t, http.StatusOK, status("/filterctl/passwd/bob@example.org/", "adminkey"))
+	require.Equal(t, http.StatusUnauthorized, status("/filterctl/books/alice@example.org/", "retiredkey"))
+	require.Equal(t, http.StatusUnauthorized, status("/filterctl/books/alice@example.org/", "wrongkey"))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rstms/rspamd-classes/classes"
+	"golang.org/x/sys/unix"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serializes read-modify-write of the classes config file within the daemon
+var configMutex sync.Mutex
+
+// hold the classes config file exclusively for a read-modify-write
+//
+// The in-process mutex orders our own handlers; the flock on a sibling lock
+// file excludes other cooperating processes.  The lock file is used because
+// writes replace the config file's inode, so external writers must lock
+// <classes file>.lock rather than the classes file; see README.md.
+func lockConfig(w http.ResponseWriter, user, request string) (func(), bool) {
+	configMutex.Lock()
+	lockFile, err := os.OpenFile(requestServer(w).classesFile+".lock", os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		configMutex.Unlock()
+		fail(w, user, request, fmt.Sprintf("configuration lock failed: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	err = unix.Flock(int(lockFile.Fd()), unix.LOCK_EX)
+	if err != nil {
+		lockFile.Close()
+		configMutex.Unlock()
+		fail(w, user, request, fmt.Sprintf("configuration lock failed: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	unlock := func() {
+		err := unix.Flock(int(lockFile.Fd()), unix.LOCK_UN)
+		if err != nil {
+			log.Printf("failed unlocking %s: %v\n", lockFile.Name(), err)
+		}
+		lockFile.Close()
+		configMutex.Unlock()
+	}
+	return unlock, true
+}
+
+// write config to a temp file and rename it over filename so readers never see a partial file
+func writeConfigFile(config *classes.SpamClasses, filename string) error {
+	mode := os.FileMode(0660)
+	uid, gid := -1, -1
+	info, err := os.Stat(filename)
+	if err == nil {
+		mode = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed creating temp file: %v", err)
+	}
+	tempName := tempFile.Name()
+	tempFile.Close()
+	defer os.Remove(tempName)
+
+	err = config.Write(tempName)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tempName, mode)
+	if err != nil {
+		return fmt.Errorf("failed setting mode: %v", err)
+	}
+	if uid != -1 && (uid != os.Getuid() || gid != os.Getgid()) {
+		err = os.Chown(tempName, uid, gid)
+		if err != nil {
+			return fmt.Errorf("failed setting owner: %v", err)
+		}
+	}
+	err = syncFile(tempName)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempName, filename)
+	if err != nil {
+		return fmt.Errorf("failed renaming %s: %v", tempName, err)
+	}
+	return nil
+}
+
+func syncFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed opening %s: %v", filename, err)
+	}
+	defer file.Close()
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed syncing %s: %v", filename, err)
+	}
+	return nil
+}
+
+// a parsed classes file with the identity of the file it was read from
+type cachedClasses struct {
+	config   *classes.SpamClasses
+	filename string
+	exists   bool
+	modTime  time.Time
+	size     int64
+	dev      uint64
+	ino      uint64
+}
+
+var classesCache atomic.Pointer[cachedClasses]
+
+func newCachedClasses(filename string, info os.FileInfo) *cachedClasses {
+	entry := cachedClasses{filename: filename}
+	if info != nil {
+		entry.exists = true
+		entry.modTime = info.ModTime()
+		entry.size = info.Size()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.dev = uint64(stat.Dev)
+			entry.ino = uint64(stat.Ino)
+		}
+	}
+	return &entry
+}
+
+func (c *cachedClasses) matches(other *cachedClasses) bool {
+	return c.filename == other.filename &&
+		c.exists == other.exists &&
+		c.modTime.Equal(other.modTime) &&
+		c.size == other.size &&
+		c.dev == other.dev &&
+		c.ino == other.ino
+}
+
+// return the classes config, reparsing the file only when it has changed
+//
+// The returned value is shared between requests and must not be modified;
+// handlers that change classes use readConfig under lockConfig instead.
+func cachedConfig(filename string) (*classes.SpamClasses, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		info = nil
+	}
+	current := newCachedClasses(filename, info)
+	entry := classesCache.Load()
+	if entry != nil && entry.matches(current) {
+		configReads.Inc("cache")
+		return entry.config, nil
+	}
+	config, err := classes.New(filename)
+	configReads.Inc("file")
+	if err != nil {
+		return nil, err
+	}
+	current.config = config
+	classesCache.Store(current)
+	return config, nil
+}
+
+func invalidateConfigCache() {
+	classesCache.Store(nil)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentThresholdUpdates(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	setVerbose(false)
+	defer setVerbose(viper.GetBool("verbose"))
+
+	before, err := os.Stat(configFile)
+	require.Nil(t, err)
+
+	const count = 20
+	var wg sync.WaitGroup
+	statuses := make([]int, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/filterctl/classes/bob@example.org/class%02d/%d/", i, 100+i)
+			req := httptest.NewRequest("PUT", path, nil)
+			result := callHandler("PUT /filterctl/classes/{address}/{name}/{threshold}/", handlePutClassThreshold, req)
+			statuses[i] = result.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for _, status := range statuses {
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	config, err := classes.New(configFile)
+	require.Nil(t, err)
+	for i := 0; i < count; i++ {
+		score, ok := config.GetThreshold("bob@example.org", fmt.Sprintf("class%02d", i))
+		require.True(t, ok, "lost update for class%02d", i)
+		require.Equal(t, float32(100+i), score)
+	}
+	_, ok := config.GetThreshold("alice@example.org", "probable")
+	require.True(t, ok)
+
+	matches, err := filepath.Glob(configFile + ".tmp*")
+	require.Nil(t, err)
+	require.Empty(t, matches)
+	info, err := os.Stat(configFile)
+	require.Nil(t, err)
+	require.Equal(t, before.Mode().Perm(), info.Mode().Perm())
+}
+
+func TestCachedConfig(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	invalidateConfigCache()
+
+	first, err := cachedConfig(configFile)
+	require.Nil(t, err)
+	second, err := cachedConfig(configFile)
+	require.Nil(t, err)
+	require.True(t, first == second, "expected cached config")
+	require.Equal(t, "ham", second.GetClass([]string{"alice@example.org"}, 7))
+
+	// an external writer replaces the file
+	config, err := classes.New(configFile)
+	require.Nil(t, err)
+	config.SetThreshold("alice@example.org", "ham", 6)
+	require.Nil(t, config.Write(configFile+".new"))
+	require.Nil(t, os.Rename(configFile+".new", configFile))
+	third, err := cachedConfig(configFile)
+	require.Nil(t, err)
+	require.False(t, third == second, "expected reload after file change")
+	require.Equal(t, "probable", third.GetClass([]string{"alice@example.org"}, 7))
+
+	// the daemon's own write invalidates the cache
+	req := httptest.NewRequest("PUT", "/filterctl/classes/alice@example.org/ham/9/", nil)
+	result := callHandler("PUT /filterctl/classes/{address}/{name}/{threshold}/", handlePutClassThreshold, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	fourth, err := cachedConfig(configFile)
+	require.Nil(t, err)
+	require.Equal(t, "ham", fourth.GetClass([]string{"alice@example.org"}, 7))
+}
+
+func initBenchmarkClassesFile(b *testing.B) {
+	configFile = filepath.Join(b.TempDir(), "classes.json")
+	config, err := classes.New("")
+	require.Nil(b, err)
+	for i := 0; i < 500; i++ {
+		config.SetClasses(fmt.Sprintf("user%03d@example.org", i), []classes.SpamClass{{Name: "ham", Score: 4}, {Name: "probable", Score: 9}, {Name: "spam", Score: 999}})
+	}
+	require.Nil(b, config.Write(configFile))
+	invalidateConfigCache()
+}
+
+func BenchmarkGetClassParse(b *testing.B) {
+	initBenchmarkClassesFile(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config, err := classes.New(configFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		config.GetClass([]string{"user250@example.org"}, 5)
+	}
+}
+
+func BenchmarkGetClassCached(b *testing.B) {
+	initBenchmarkClassesFile(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config, err := cachedConfig(configFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		config.GetClass([]string{"user250@example.org"}, 5)
+	}
+}
+
+func BenchmarkGetClassCachedParallel(b *testing.B) {
+	initBenchmarkClassesFile(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			config, err := cachedConfig(configFile)
+			if err != nil {
+				b.Fatal(err)
+			}
+			config.GetClass([]string{"user250@example.org"}, 5)
+		}
+	})
+}
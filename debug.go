@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+type FdsResponse struct {
+	api.Response
+	Fds map[string]string
+}
+
+// debug endpoints are disabled unless debug_endpoints is set, and then need a
+// credential that names the endpoint or debug explicitly; * and HTTP methods
+// do not grant them.  The api key must grant the endpoint, or the peer policy
+// when a unix socket peer sends no key.
+func checkDebug(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	config := requestConfig(w)
+	if !config.DebugEndpoints {
+		systemFail(w, endpoint, "debug endpoints disabled", http.StatusNotFound)
+		return false
+	}
+	if !checkClientCert(w, r, endpoint) {
+		return false
+	}
+	var endpoints []string
+	if rw, ok := requestState(w); ok && rw.apiKey != nil {
+		endpoints = rw.apiKey.Endpoints
+	} else if peer, ok := requestPeer(r); ok {
+		if policy, ok := config.Peer(peer.Uid); ok {
+			endpoints = policy.Endpoints
+		}
+	}
+	if !slices.Contains(endpoints, endpoint) && !slices.Contains(endpoints, "debug") {
+		fail(w, "system", endpoint, fmt.Sprintf("%s requires an explicit %s or debug grant", endpoint, endpoint), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serve a net/http/pprof handler, which expects paths under /debug/pprof/
+//
+// The handlers are mounted on the server mux only; the routes net/http/pprof
+// registers on http.DefaultServeMux are never served.
+func pprofHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return http.StripPrefix("/filterctl", handler).ServeHTTP
+}
+
+// return the targets of this process's open file descriptors
+func listFds() (map[string]string, error) {
+	dir := "/proc/self/fd"
+	if _, err := os.Stat(dir); err != nil {
+		dir = "/dev/fd"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	fds := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			target = ""
+		}
+		fds[entry.Name()] = target
+	}
+	return fds, nil
+}
+
+func handleGetFds(w http.ResponseWriter, r *http.Request) {
+	requestString := "list fds"
+	fds, err := listFds()
+	if err != nil {
+		fail(w, "system", requestString, fmt.Sprintf("failed listing fds: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var response FdsResponse
+	response.User = "system"
+	response.Request = requestString
+	response.Success = true
+	response.Fds = fds
+	response.Message = fmt.Sprintf("%d open fds", len(fds))
+	succeed(w, response.Message, &response)
+}
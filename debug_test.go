@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func debugRequest(path, apiKey string) *http.Request {
+	req := certRequest("GET", "CN=filterctl", apiKey)
+	req.URL = httptest.NewRequest("GET", path, nil).URL
+	return req
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	Initialize(t)
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+	proxies, err := parseTrustedProxies(defaultTrustedProxies)
+	require.Nil(t, err)
+	config := ServerConfig{
+		ApiKeys: []ApiKey{
+			{Name: "admin", Key: "adminkey", Endpoints: []string{"*"}},
+			{Name: "reader", Key: "readerkey", Endpoints: []string{"GET"}},
+			{Name: "webmail", Key: "webmailkey", Endpoints: []string{"list_books"}},
+			{Name: "debugger", Key: "debugkey", Endpoints: []string{"debug"}},
+			{Name: "profiler", Key: "profilekey", Endpoints: []string{"debug_pprof"}},
+		},
+		ClientCerts:    defaultClientCerts,
+		TrustedProxies: proxies,
+	}
+	activeConfig.Store(&config)
+	defer activeConfig.Store(nil)
+	server := NewServer(&activeConfig, configFile, nil)
+	serve := func(req *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	result := serve(debugRequest("/filterctl/debug/fds", "debugkey"))
+	require.Equal(t, http.StatusNotFound, result.StatusCode)
+
+	enabled := config
+	enabled.DebugEndpoints = true
+	activeConfig.Store(&enabled)
+
+	// * and methods do not grant debug endpoints
+	for _, key := range []string{"webmailkey", "adminkey", "readerkey", "profilekey"} {
+		result = serve(debugRequest("/filterctl/debug/fds", key))
+		require.Equal(t, http.StatusForbidden, result.StatusCode, key)
+	}
+
+	result = serve(debugRequest("/filterctl/debug/fds", "debugkey"))
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response FdsResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.NotEmpty(t, response.Fds)
+
+	result = serve(debugRequest("/filterctl/debug/pprof/", "adminkey"))
+	require.Equal(t, http.StatusForbidden, result.StatusCode)
+
+	body := func(path string) string {
+		result := serve(debugRequest(path, "profilekey"))
+		require.Equal(t, http.StatusOK, result.StatusCode, path)
+		data, err := io.ReadAll(result.Body)
+		require.Nil(t, err)
+		return string(data)
+	}
+	require.Contains(t, body("/filterctl/debug/pprof/"), "goroutine?debug=1")
+	require.Contains(t, body("/filterctl/debug/pprof/goroutine?debug=1"), "goroutine profile:")
+	require.NotEmpty(t, body("/filterctl/debug/pprof/cmdline"))
+	require.Contains(t, body("/filterctl/debug/pprof/symbol"), "num_symbols")
+	require.NotEmpty(t, body("/filterctl/debug/pprof/profile?seconds=1"))
+
+	result = serve(debugRequest("/filterctl/debug/pprof/nonesuch", "profilekey"))
+	require.Equal(t, http.StatusNotFound, result.StatusCode)
+}
+
+func TestNoDefaultPprofRoutes(t *testing.T) {
+	// net/http/pprof registers on the default mux, which the server never serves
+	server := NewServer(&activeConfig, configFile, nil)
+	_, pattern := server.mux.Handler(httptest.NewRequest("GET", "/debug/pprof/", nil))
+	require.Equal(t, "", pattern)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/rspamd-classes/classes"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type CheckResult struct {
+	Ok      bool
+	Message string
+	Elapsed string
+}
+
+type ReadyResponse struct {
+	api.Response
+	Checks map[string]CheckResult
+}
+
+type readinessCheck struct {
+	name  string
+	check func(s *Server) error
+}
+
+// dependencies verified by the ready endpoint
+var readinessChecks = []readinessCheck{
+	{"classes", checkClassesFile},
+	{"address_book", checkAddressBook},
+}
+
+func checkClassesFile(s *Server) error {
+	// classes.New falls back to defaults for a missing file
+	_, err := os.Stat(s.classesFile)
+	if err != nil {
+		return fmt.Errorf("classes file %s unreadable: %v", s.classesFile, err)
+	}
+	_, err = classes.New(s.classesFile)
+	if err != nil {
+		return fmt.Errorf("classes file %s corrupt: %v", s.classesFile, err)
+	}
+	return nil
+}
+
+func checkAddressBook(s *Server) error {
+	mabLock.Lock()
+	mab, err := s.newController()
+	mabLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("address book controller init failed: %v", err)
+	}
+	_, err = mab.GetStatus()
+	if err != nil {
+		return fmt.Errorf("address book backend unreachable: %v", err)
+	}
+	return nil
+}
+
+// how long readiness results are reused, so the unauthenticated ready
+// endpoint cannot multiply load onto the address book backend
+const readyCacheTTL = 5 * time.Second
+
+// how long the readiness checks may run before they are reported as failed
+var readyCheckTimeout = 3 * time.Second
+
+// readiness results; refresh is closed when the running refresh completes,
+// and is nil while none runs
+type readyCache struct {
+	mutex   sync.Mutex
+	checked time.Time
+	checks  map[string]CheckResult
+	failed  []string
+	refresh chan struct{}
+}
+
+// return the readiness results from the last readyCacheTTL, or refresh them
+//
+// Concurrent callers share one refresh, and the cache mutex is not held
+// while the checks run.
+func (s *Server) readiness() (map[string]CheckResult, []string) {
+	s.ready.mutex.Lock()
+	if !s.ready.checked.IsZero() && time.Since(s.ready.checked) < readyCacheTTL {
+		defer s.ready.mutex.Unlock()
+		return s.ready.checks, s.ready.failed
+	}
+	done := s.ready.refresh
+	if done == nil {
+		done = make(chan struct{})
+		s.ready.refresh = done
+		go s.refreshReadiness(done)
+	}
+	s.ready.mutex.Unlock()
+	<-done
+	s.ready.mutex.Lock()
+	defer s.ready.mutex.Unlock()
+	return s.ready.checks, s.ready.failed
+}
+
+func (s *Server) refreshReadiness(done chan struct{}) {
+	checks, failed := s.runReadinessChecks()
+	s.ready.mutex.Lock()
+	s.ready.checked = time.Now()
+	s.ready.checks = checks
+	s.ready.failed = failed
+	s.ready.refresh = nil
+	s.ready.mutex.Unlock()
+	close(done)
+}
+
+// run the checks concurrently, failing any still running at the deadline
+func (s *Server) runReadinessChecks() (map[string]CheckResult, []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+	defer cancel()
+	results := make([]chan CheckResult, len(readinessChecks))
+	for i, check := range readinessChecks {
+		results[i] = make(chan CheckResult, 1)
+		go func() {
+			start := time.Now()
+			err := check.check(s)
+			result := CheckResult{Ok: err == nil, Message: "ok", Elapsed: time.Since(start).String()}
+			if err != nil {
+				result.Message = err.Error()
+			}
+			results[i] <- result
+		}()
+	}
+	checks := make(map[string]CheckResult, len(readinessChecks))
+	failed := []string{}
+	for i, check := range readinessChecks {
+		var result CheckResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			result = CheckResult{Message: fmt.Sprintf("timed out after %v", readyCheckTimeout), Elapsed: readyCheckTimeout.String()}
+		}
+		if !result.Ok {
+			failed = append(failed, check.name)
+		}
+		checks[check.name] = result
+	}
+	return checks, failed
+}
+
+func handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	// liveness only; the process is serving requests
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(api.Response{User: "system", Request: "health", Success: true, Message: "ok"})
+}
+
+func handleGetReady(w http.ResponseWriter, r *http.Request) {
+	var response ReadyResponse
+	response.User = "system"
+	response.Request = "ready"
+	var failed []string
+	response.Checks, failed = requestServer(w).readiness()
+	response.Success = len(failed) == 0
+	if !response.Success {
+		response.Message = fmt.Sprintf("not ready: %v", failed)
+		logf(w, "  [%d] %s", http.StatusServiceUnavailable, response.Message)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&response)
+		return
+	}
+	response.Message = "ready"
+	succeed(w, response.Message, &response)
+}
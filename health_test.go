@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getReady(t *testing.T) (int, ReadyResponse) {
+	req := httptest.NewRequest("GET", "/filterctl/ready", nil)
+	result := callHandler("GET /filterctl/ready", handleGetReady, req)
+	var response ReadyResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	return result.StatusCode, response
+}
+
+func TestReady(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	saved := readinessChecks
+	defer func() { readinessChecks = saved }()
+	backendErr := fmt.Errorf("address book backend unreachable: connection refused")
+	readinessChecks = []readinessCheck{
+		{"classes", checkClassesFile},
+		{"address_book", func(*Server) error { return backendErr }},
+	}
+
+	status, response := getReady(t)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.False(t, response.Success)
+	require.True(t, response.Checks["classes"].Ok)
+	require.False(t, response.Checks["address_book"].Ok)
+	require.Equal(t, backendErr.Error(), response.Checks["address_book"].Message)
+
+	backendErr = nil
+	status, response = getReady(t)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, response.Success)
+
+	require.Nil(t, os.WriteFile(configFile, []byte("{not json"), 0600))
+	status, response = getReady(t)
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.False(t, response.Checks["classes"].Ok)
+	require.True(t, response.Checks["address_book"].Ok)
+}
+
+func TestReadyCached(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	saved := readinessChecks
+	defer func() { readinessChecks = saved }()
+	var calls atomic.Int32
+	readinessChecks = []readinessCheck{
+		{"classes", checkClassesFile},
+		{"address_book", func(*Server) error { calls.Add(1); return nil }},
+	}
+	server := NewServer(&activeConfig, configFile, nil)
+	for range 3 {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/filterctl/ready", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+	require.Equal(t, int32(1), calls.Load())
+
+	// a hung check fails at the deadline, and concurrent probes share one refresh
+	timeout := readyCheckTimeout
+	defer func() { readyCheckTimeout = timeout }()
+	readyCheckTimeout = 50 * time.Millisecond
+	hung := make(chan struct{})
+	defer close(hung)
+	readinessChecks = []readinessCheck{
+		{"classes", checkClassesFile},
+		{"address_book", func(*Server) error { calls.Add(1); <-hung; return nil }},
+	}
+	server = NewServer(&activeConfig, configFile, nil)
+	statuses := make(chan int, 3)
+	for range 3 {
+		go func() {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest("GET", "/filterctl/ready", nil))
+			statuses <- w.Result().StatusCode
+		}()
+	}
+	for range 3 {
+		select {
+		case status := <-statuses:
+			require.Equal(t, http.StatusServiceUnavailable, status)
+		case <-time.After(time.Second):
+			t.Fatal("ready blocked on a hung check")
+		}
+	}
+	require.Equal(t, int32(2), calls.Load())
+
+	// a missing classes file is not ready
+	server = NewServer(&activeConfig, filepath.Join(t.TempDir(), "missing.json"), nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/filterctl/ready", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+}
+
+func TestHealth(t *testing.T) {
+	Initialize(t)
+	req := httptest.NewRequest("GET", "/filterctl/health", nil)
+	result := callHandler("GET /filterctl/health", handleGetHealth, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+}
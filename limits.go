@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// largest request body accepted by default; restore requests carry a full address book dump
+const defaultMaxBodySize = 16 << 20
+
+// connections accepted and not yet closed
+var activeConnections atomic.Int64
+
+// HTTP listeners, timeouts and resource limits; these are applied at startup and not reloaded
+type HTTPConfig struct {
+	Listen            []ListenConfig
+	UnixSocket        *UnixSocketConfig
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxBodySize       int64
+	MaxConnections    int
+	FileLimit         uint64
+}
+
+func newHTTPConfig(v *viper.Viper, port int) (*HTTPConfig, error) {
+	config := HTTPConfig{
+		ReadHeaderTimeout: v.GetDuration("http.read_header_timeout"),
+		ReadTimeout:       v.GetDuration("http.read_timeout"),
+		WriteTimeout:      v.GetDuration("http.write_timeout"),
+		IdleTimeout:       v.GetDuration("http.idle_timeout"),
+		MaxHeaderBytes:    v.GetInt("http.max_header_bytes"),
+		MaxBodySize:       int64(v.GetSizeInBytes("http.max_body_size")),
+		MaxConnections:    v.GetInt("http.max_connections"),
+		FileLimit:         uint64(v.GetInt64("http.rlimit_nofile")),
+	}
+	var err error
+	config.Listen, err = newListenConfigs(v, port)
+	if err != nil {
+		return nil, err
+	}
+	config.UnixSocket, err = newUnixSocketConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	for name, timeout := range map[string]time.Duration{
+		"read_header_timeout": config.ReadHeaderTimeout,
+		"read_timeout":        config.ReadTimeout,
+		"write_timeout":       config.WriteTimeout,
+		"idle_timeout":        config.IdleTimeout,
+	} {
+		if timeout <= 0 {
+			return nil, fmt.Errorf("invalid http.%s: %v", name, timeout)
+		}
+	}
+	if config.MaxHeaderBytes <= 0 {
+		return nil, fmt.Errorf("invalid http.max_header_bytes: %d", config.MaxHeaderBytes)
+	}
+	if config.MaxBodySize <= 0 {
+		return nil, fmt.Errorf("invalid http.max_body_size: %d", config.MaxBodySize)
+	}
+	if config.MaxConnections < 0 {
+		return nil, fmt.Errorf("invalid http.max_connections: %d", config.MaxConnections)
+	}
+	return &config, nil
+}
+
+// raise the soft open file limit toward target, capped at the hard limit
+func raiseFileLimit(target uint64) (unix.Rlimit, error) {
+	rLimit, err := fileLimit()
+	if err != nil {
+		return rLimit, err
+	}
+	if target == 0 || uint64(rLimit.Cur) >= target {
+		return rLimit, nil
+	}
+	rLimit.Cur = clampLimit(target, rLimit.Max)
+	err = unix.Setrlimit(unix.RLIMIT_NOFILE, &rLimit)
+	if err != nil {
+		return rLimit, fmt.Errorf("failed setting open file limit to %d: %v", rLimit.Cur, err)
+	}
+	return fileLimit()
+}
+
+// return target capped at max in the rlimit field type, which is int64 on
+// FreeBSD and uint64 elsewhere
+func clampLimit[T int64 | uint64](target uint64, max T) T {
+	return T(min(target, uint64(max)))
+}
+
+// a listener accepting connections only while a slot is free
+//
+// Listeners sharing slots share one cap on concurrent connections.  Accept
+// blocks while the cap is reached, leaving further clients in the kernel
+// backlog rather than consuming descriptors, until Close releases it.  With
+// nil slots connections are only counted in activeConnections.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// return the slots for limit concurrent connections; nil means no limit
+func connectionSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+func newLimitListener(listener net.Listener, slots chan struct{}) net.Listener {
+	return &limitListener{Listener: listener, slots: slots, done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.releaseSlot()
+		return nil, err
+	}
+	activeConnections.Add(1)
+	return &limitConn{Conn: conn, release: func() {
+		activeConnections.Add(-1)
+		l.releaseSlot()
+	}}, nil
+}
+
+func (l *limitListener) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPConfig(t *testing.T) {
+	v := viper.New()
+	setDefaults(v)
+	config, err := newHTTPConfig(v, defaultPort)
+	require.Nil(t, err)
+	require.Equal(t, 10*time.Second, config.ReadHeaderTimeout)
+	require.Equal(t, int64(defaultMaxBodySize), config.MaxBodySize)
+	require.Equal(t, 256, config.MaxConnections)
+
+	v.Set("http.max_body_size", "1mb")
+	config, err = newHTTPConfig(v, defaultPort)
+	require.Nil(t, err)
+	require.Equal(t, int64(1<<20), config.MaxBodySize)
+
+	v.Set("http.write_timeout", "0s")
+	_, err = newHTTPConfig(v, defaultPort)
+	require.NotNil(t, err)
+}
+
+func TestRaiseFileLimit(t *testing.T) {
+	before, err := fileLimit()
+	require.Nil(t, err)
+	// a lower target never reduces the limit
+	after, err := raiseFileLimit(1)
+	require.Nil(t, err)
+	require.Equal(t, before.Cur, after.Cur)
+
+	require.Equal(t, int64(100), clampLimit(100, int64(4096)))
+	require.Equal(t, uint64(4096), clampLimit(8192, uint64(4096)))
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	listener := newLimitListener(inner, connectionSlots(1))
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", inner.Addr().String())
+	require.Nil(t, err)
+	defer first.Close()
+	conn := <-accepted
+	require.Equal(t, int64(1), activeConnections.Load())
+
+	second, err := net.Dial("tcp", inner.Addr().String())
+	require.Nil(t, err)
+	defer second.Close()
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Close()
+	conn.Close()
+	select {
+	case conn = <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted after a slot was released")
+	}
+}
+
+func TestUnlimitedListenerCounts(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	listener := newLimitListener(inner, connectionSlots(0))
+	defer listener.Close()
+	before := activeConnections.Load()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	require.Nil(t, err)
+	defer client.Close()
+	conn, err := listener.Accept()
+	require.Nil(t, err)
+	require.Equal(t, before+1, activeConnections.Load())
+	conn.Close()
+	require.Equal(t, before, activeConnections.Load())
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	slots := connectionSlots(1)
+	// another listener holds the only shared slot
+	slots <- struct{}{}
+	listener := newLimitListener(inner, slots)
+
+	accepted := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted without a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Nil(t, listener.Close())
+	select {
+	case err := <-accepted:
+		require.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Accept blocked after Close")
+	}
+	require.NotNil(t, listener.Close())
+}
+
+func TestServerMaxBodySize(t *testing.T) {
+	server := NewServer(&activeConfig, configFile, nil)
+	server.maxBodySize = 16
+	server.route("POST /test/body", func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test/body", strings.NewReader("short")))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/test/body", strings.NewReader(strings.Repeat("x", 17))))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+}
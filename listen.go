@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/spf13/viper"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var defaultListen = []string{"127.0.0.1"}
+
+// a TCP listen address and the transport security required on it
+//
+// Address is a host name or IP with an optional port; IPv6 addresses may be
+// bare or bracketed.  TLS defaults to tls.enabled.  RequireClientCert fails
+// TLS handshakes without a client certificate signed by tls.client_ca, so
+// requests on the listener cannot authenticate with the X-Client-Cert-Dn
+// header of a trusted proxy.
+type ListenConfig struct {
+	Address           string
+	TLS               bool
+	RequireClientCert bool
+}
+
+var listenKeys = []string{"address", "tls", "require_client_cert"}
+
+// parse the listen list, whose entries are addresses or maps of listenKeys
+func newListenConfigs(v *viper.Viper, port int) ([]ListenConfig, error) {
+	var entries []any
+	switch value := v.Get("listen").(type) {
+	case nil:
+	case string:
+		entries = []any{value}
+	case []string:
+		for _, address := range value {
+			entries = append(entries, address)
+		}
+	case []any:
+		entries = value
+	default:
+		return nil, fmt.Errorf("invalid listen: %v", value)
+	}
+	listens := []ListenConfig{}
+	for _, entry := range entries {
+		listen := ListenConfig{TLS: v.GetBool("tls.enabled")}
+		switch value := entry.(type) {
+		case string:
+			listen.Address = value
+		case map[string]any:
+			for key := range value {
+				if !slices.Contains(listenKeys, key) {
+					return nil, fmt.Errorf("listen: unknown key '%s'", key)
+				}
+			}
+			var ok bool
+			listen.Address, ok = value["address"].(string)
+			if !ok {
+				return nil, fmt.Errorf("listen: missing address in %v", value)
+			}
+			if setting, present := value["tls"]; present {
+				listen.TLS, ok = setting.(bool)
+				if !ok {
+					return nil, fmt.Errorf("listen: %s: invalid tls: %v", listen.Address, setting)
+				}
+			}
+			if setting, present := value["require_client_cert"]; present {
+				listen.RequireClientCert, ok = setting.(bool)
+				if !ok {
+					return nil, fmt.Errorf("listen: %s: invalid require_client_cert: %v", listen.Address, setting)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("listen: invalid entry: %v", entry)
+		}
+		address, err := listenAddress(listen.Address, port)
+		if err != nil {
+			return nil, err
+		}
+		listen.Address = address
+		if listen.RequireClientCert && !listen.TLS {
+			return nil, fmt.Errorf("listen: %s: require_client_cert needs tls", listen.Address)
+		}
+		for _, other := range listens {
+			if other.Address == listen.Address {
+				return nil, fmt.Errorf("listen: duplicate address %s", listen.Address)
+			}
+		}
+		listens = append(listens, listen)
+	}
+	if len(listens) == 0 {
+		return nil, fmt.Errorf("listen is empty")
+	}
+	return listens, nil
+}
+
+// return address as host:port, adding port if it has none
+func listenAddress(address string, port int) (string, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		// a bare host, or a bare or bracketed IPv6 address
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		portString = strconv.Itoa(port)
+	}
+	if host == "" || strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("listen: invalid address '%s'", address)
+	}
+	number, err := strconv.Atoi(portString)
+	if err != nil || number < 0 || number > 65535 {
+		return "", fmt.Errorf("listen: invalid port in '%s'", address)
+	}
+	return net.JoinHostPort(host, portString), nil
+}
+
+func (l ListenConfig) String() string {
+	switch {
+	case l.RequireClientCert:
+		return l.Address + " (TLS, client cert required)"
+	case l.TLS:
+		return l.Address + " (TLS)"
+	}
+	return l.Address
+}
+
+// return the TLS config for this listener from the server's
+func (l ListenConfig) tlsConfig(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	if l.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// offer the protocols ServeTLS would
+	config.NextProtos = []string{"h2", "http/1.1"}
+	return config
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestListenConfigs(t *testing.T) {
+	v := viper.New()
+	setDefaults(v)
+	listens, err := newListenConfigs(v, defaultPort)
+	require.Nil(t, err)
+	require.Equal(t, []ListenConfig{{Address: "127.0.0.1:2016"}}, listens)
+
+	v.Set("listen", []any{
+		"127.0.0.1",
+		"::1",
+		"[::1]:2017",
+		map[string]any{"address": "10.0.0.5", "tls": true, "require_client_cert": true},
+	})
+	listens, err = newListenConfigs(v, defaultPort)
+	require.Nil(t, err)
+	require.Equal(t, []ListenConfig{
+		{Address: "127.0.0.1:2016"},
+		{Address: "[::1]:2016"},
+		{Address: "[::1]:2017"},
+		{Address: "10.0.0.5:2016", TLS: true, RequireClientCert: true},
+	}, listens)
+
+	// listeners default to tls.enabled
+	v.Set("tls.enabled", true)
+	v.Set("listen", []string{"[::1]"})
+	listens, err = newListenConfigs(v, 2020)
+	require.Nil(t, err)
+	require.Equal(t, []ListenConfig{{Address: "[::1]:2020", TLS: true}}, listens)
+
+	v.Set("tls.enabled", false)
+	for _, invalid := range []any{
+		[]any{map[string]any{"address": "10.0.0.5", "require_client_cert": true}},
+		[]any{map[string]any{"address": "10.0.0.5", "mtls": true}},
+		[]any{map[string]any{"tls": true}},
+		[]string{"127.0.0.1", "127.0.0.1:2016"},
+		[]string{"127.0.0.1:http"},
+		[]string{""},
+		[]string{},
+	} {
+		v.Set("listen", invalid)
+		_, err = newListenConfigs(v, defaultPort)
+		require.NotNil(t, err, "%v", invalid)
+	}
+}
+
+func TestListenTLSConfig(t *testing.T) {
+	base := &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven}
+	config := ListenConfig{Address: "10.0.0.5:2016", TLS: true, RequireClientCert: true}.tlsConfig(base)
+	require.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+	require.Equal(t, []string{"h2", "http/1.1"}, config.NextProtos)
+	config = ListenConfig{Address: "127.0.0.1:2016", TLS: true}.tlsConfig(base)
+	require.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+	require.Nil(t, base.NextProtos)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const logRotateCheckInterval = time.Minute
+
+// size and age limits for the daemon log file; zero MaxSize and Interval disable rotation
+//
+// Rotated files are renamed to logfile.0 (newest) through logfile.<Keep-1>.
+type LogRotateConfig struct {
+	MaxSize  int64
+	Interval time.Duration
+	Keep     int
+}
+
+func newLogRotateConfig(v *viper.Viper) (*LogRotateConfig, error) {
+	config := LogRotateConfig{
+		MaxSize:  int64(v.GetSizeInBytes("log_rotate.max_size")),
+		Interval: v.GetDuration("log_rotate.interval"),
+		Keep:     v.GetInt("log_rotate.keep"),
+	}
+	if config.Interval < 0 {
+		return nil, fmt.Errorf("invalid log_rotate.interval: %v", config.Interval)
+	}
+	if config.Keep < 0 {
+		return nil, fmt.Errorf("invalid log_rotate.keep: %d", config.Keep)
+	}
+	return &config, nil
+}
+
+func (c *LogRotateConfig) Enabled() bool {
+	return c != nil && (c.MaxSize > 0 || c.Interval > 0)
+}
+
+func (c LogRotateConfig) String() string {
+	return fmt.Sprintf("max_size=%d interval=%v keep=%d", c.MaxSize, c.Interval, c.Keep)
+}
+
+// the daemon log file, which go-daemon connects to stdout and stderr
+type daemonLog struct {
+	mutex  sync.Mutex
+	path   string
+	perm   os.FileMode
+	fds    []int
+	opened time.Time
+}
+
+var daemonLogFile daemonLog
+
+func (l *daemonLog) Init(path string, perm os.FileMode) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.path = path
+	l.perm = perm
+	l.fds = []int{int(os.Stdout.Fd()), int(os.Stderr.Fd())}
+	l.opened = time.Now()
+}
+
+// open the log file path again, replacing the descriptors that write to it
+func (l *daemonLog) Reopen() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.reopen()
+}
+
+func (l *daemonLog) reopen() error {
+	if l.path == "" {
+		return fmt.Errorf("no log file")
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, l.perm)
+	if err != nil {
+		return fmt.Errorf("failed opening %s: %v", l.path, err)
+	}
+	defer file.Close()
+	for _, fd := range l.fds {
+		err = unix.Dup2(int(file.Fd()), fd)
+		if err != nil {
+			return fmt.Errorf("failed redirecting fd %d to %s: %v", fd, l.path, err)
+		}
+	}
+	l.opened = time.Now()
+	return nil
+}
+
+// rotate the log file if it has exceeded the configured size or age
+func (l *daemonLog) Rotate(config *LogRotateConfig, now time.Time) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.path == "" || !config.Enabled() {
+		return false, nil
+	}
+	info, err := os.Stat(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, l.reopen()
+		}
+		return false, err
+	}
+	if info.Size() == 0 {
+		return false, nil
+	}
+	oversize := config.MaxSize > 0 && info.Size() >= config.MaxSize
+	expired := config.Interval > 0 && now.Sub(l.opened) >= config.Interval
+	if !oversize && !expired {
+		return false, nil
+	}
+	if config.Keep == 0 {
+		err = os.Remove(l.path)
+		if err != nil {
+			return false, err
+		}
+		return true, l.reopen()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, config.Keep-1))
+	for i := config.Keep - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", l.path, i-1), fmt.Sprintf("%s.%d", l.path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	err = os.Rename(l.path, l.path+".0")
+	if err != nil {
+		return false, err
+	}
+	return true, l.reopen()
+}
+
+// periodically check the log file against the active rotation config
+func runLogRotation() {
+	ticker := time.NewTicker(logRotateCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		rotated, err := daemonLogFile.Rotate(currentConfig().LogRotate, now)
+		if err != nil {
+			log.Printf("log rotation failed: %v\n", err)
+		} else if rotated {
+			log.Printf("log file rotated\n")
+		}
+	}
+}
+
+func reopenHandler(sig os.Signal) error {
+	audit.Reopen()
+	scanAudit.Reopen()
+	err := daemonLogFile.Reopen()
+	if err != nil {
+		log.Printf("log reopen failed: %v\n", err)
+		return nil
+	}
+	log.Println("received reopen signal; log file reopened")
+	return nil
+}
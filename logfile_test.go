@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogRotateConfig(t *testing.T) {
+	v := viper.New()
+	v.Set("log_rotate.max_size", "10mb")
+	v.Set("log_rotate.interval", "24h")
+	v.Set("log_rotate.keep", 3)
+	config, err := newLogRotateConfig(v)
+	require.Nil(t, err)
+	require.Equal(t, int64(10*1024*1024), config.MaxSize)
+	require.Equal(t, 24*time.Hour, config.Interval)
+	require.True(t, config.Enabled())
+
+	config, err = newLogRotateConfig(viper.New())
+	require.Nil(t, err)
+	require.False(t, config.Enabled())
+
+	v.Set("log_rotate.keep", -1)
+	_, err = newLogRotateConfig(v)
+	require.NotNil(t, err)
+}
+
+func TestLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filterctld")
+	// stands in for the daemon's stdout
+	output, err := os.Create(filepath.Join(dir, "output"))
+	require.Nil(t, err)
+	defer output.Close()
+
+	l := daemonLog{path: path, perm: 0600, fds: []int{int(output.Fd())}, opened: time.Now()}
+	require.Nil(t, l.Reopen())
+	_, err = output.WriteString("first\n")
+	require.Nil(t, err)
+
+	config := &LogRotateConfig{MaxSize: 1024, Keep: 2}
+	rotated, err := l.Rotate(config, time.Now())
+	require.Nil(t, err)
+	require.False(t, rotated)
+
+	for i, line := range []string{"second\n", "third\n"} {
+		rotated, err = l.Rotate(&LogRotateConfig{MaxSize: 1, Keep: 2}, time.Now())
+		require.Nil(t, err)
+		require.True(t, rotated, i)
+		_, err = output.WriteString(line)
+		require.Nil(t, err)
+	}
+	rotated, err = l.Rotate(&LogRotateConfig{Interval: time.Hour, Keep: 2}, time.Now().Add(2*time.Hour))
+	require.Nil(t, err)
+	require.True(t, rotated)
+
+	expected := map[string]string{"filterctld": "", "filterctld.0": "third\n", "filterctld.1": "second\n"}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.Nil(t, err)
+		require.Equal(t, content, string(data), name)
+	}
+	_, err = os.Stat(filepath.Join(dir, "filterctld.2"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// structured logger; nil when logging plain text lines
+var logger *slog.Logger
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// field names whose values are masked in logged structures
+var secretFieldPattern = regexp.MustCompile(`(?i)^(password|passwd|secret|key|api_?key|token)$`)
+
+const redactedValue = "REDACTED"
+
+// select the log format; json and logfmt also route the standard logger through slog
+func setupLogging(format string, output io.Writer) error {
+	var handler slog.Handler
+	switch format {
+	case "", LogFormatText:
+		logger = nil
+		return nil
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(output, nil)
+	case LogFormatLogfmt:
+		handler = slog.NewTextHandler(output, nil)
+	default:
+		return fmt.Errorf("unknown log format: '%s'", format)
+	}
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+	return nil
+}
+
+// return the client's X-Request-Id if usable, otherwise a new random id
+func requestId(r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if requestIdPattern.MatchString(id) {
+		return id
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func requestAttrs(w http.ResponseWriter) []any {
+	attrs := []any{}
+	rw, ok := requestState(w)
+	if !ok {
+		return attrs
+	}
+	if rw.id != "" {
+		attrs = append(attrs, "request_id", rw.id)
+	}
+	if rw.apiKey != nil {
+		attrs = append(attrs, "api_key", rw.apiKey.Name)
+	}
+	return attrs
+}
+
+// log with the request's id and authentication context
+func logf(w http.ResponseWriter, format string, args ...any) {
+	args = redactArgs(args)
+	if logger != nil {
+		logger.Info(strings.TrimSpace(fmt.Sprintf(format, args...)), requestAttrs(w)...)
+		return
+	}
+	rw, ok := requestState(w)
+	if ok {
+		if rw.apiKey != nil {
+			format = "key=" + rw.apiKey.Name + " " + format
+		}
+		if rw.id != "" {
+			format = "req=" + rw.id + " " + format
+		}
+	}
+	log.Printf(format, args...)
+}
+
+// log a structure as a single record; plain text mode writes a labeled multi-line dump
+func logData(w http.ResponseWriter, label string, data any, attrs ...any) error {
+	data = redact(data)
+	if logger != nil {
+		logger.Info(label, append(append(requestAttrs(w), attrs...), slog.Any("data", data))...)
+		return nil
+	}
+	dump, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	fields := []string{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		fields = append(fields, fmt.Sprintf("%v=%v", attrs[i], attrs[i+1]))
+	}
+	logf(w, "BEGIN-%s: %s\n%s\nEND-%s\n", label, strings.Join(fields, " "), string(dump), label)
+	return nil
+}
+
+// return a copy of data with secret fields masked, suitable for logging
+func redact(data any) any {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("<%T: %v>", data, err)
+	}
+	var value any
+	err = json.Unmarshal(buf, &value)
+	if err != nil {
+		return fmt.Sprintf("<%T: %v>", data, err)
+	}
+	return redactValue(value)
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if secretFieldPattern.MatchString(key) {
+				if item != nil && item != "" {
+					v[key] = redactedValue
+				}
+			} else {
+				v[key] = redactValue(item)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// replace structured logf arguments with their redacted JSON form
+func redactArgs(args []any) []any {
+	var redacted []any
+	for i, arg := range args {
+		if !mayContainSecrets(arg) {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]any{}, args...)
+		}
+		dump, err := json.Marshal(redact(arg))
+		if err != nil {
+			redacted[i] = fmt.Sprintf("<%T>", arg)
+			continue
+		}
+		redacted[i] = string(dump)
+	}
+	if redacted == nil {
+		return args
+	}
+	return redacted
+}
+
+// structs and containers of structs may hold secret fields; errors and Stringers format themselves
+func mayContainSecrets(arg any) bool {
+	switch arg.(type) {
+	case nil, error, fmt.Stringer:
+		return false
+	}
+	return hasStructFields(reflect.TypeOf(arg))
+}
+
+func hasStructFields(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Struct:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return hasStructFields(t.Elem())
+	case reflect.Interface:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/rstms/mabctl/api"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func captureStructuredLog(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	require.Nil(t, setupLogging(format, &buf))
+	t.Cleanup(func() {
+		logger = nil
+		log.SetOutput(os.Stdout)
+		log.SetFlags(log.LstdFlags)
+	})
+	return &buf
+}
+
+func TestStructuredLogRequestId(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	buf := captureStructuredLog(t, LogFormatJSON)
+	server := NewServer(&activeConfig, configFile, nil)
+	server.route("GET /test/logging/class/{address}/{score}/", handleGetClass)
+
+	req := httptest.NewRequest("GET", "/test/logging/class/alice@example.org/3/", nil)
+	req.Header.Set("X-Request-Id", "req-1234")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "req-1234", w.Result().Header.Get("X-Request-Id"))
+
+	req = httptest.NewRequest("GET", "/test/logging/class/alice@example.org/3/", nil)
+	req.Header.Set("X-Request-Id", "bad id\nvalue")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	generated := w.Result().Header.Get("X-Request-Id")
+	require.Len(t, generated, 16)
+
+	records := 0
+	ids := map[string]int{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record map[string]any
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		require.Contains(t, record, "msg")
+		if id, ok := record["request_id"]; ok {
+			ids[id.(string)]++
+		}
+		records++
+	}
+	require.Greater(t, records, 0)
+	require.Greater(t, ids["req-1234"], 0)
+	require.Greater(t, ids[generated], 0)
+}
+
+func TestLogFormat(t *testing.T) {
+	require.NotNil(t, setupLogging("xml", os.Stderr))
+	require.Nil(t, setupLogging(LogFormatText, os.Stderr))
+	require.Nil(t, logger)
+}
+
+func TestRedactSecrets(t *testing.T) {
+	Initialize(t)
+	defer log.SetOutput(os.Stdout)
+	setVerbose(true)
+	secrets := []string{"hunter2", "restore-password", "scan-secret", "key-value"}
+	dump := api.ConfigDump{Users: map[string]api.UserDump{
+		"alice@example.org": {Password: "restore-password", Books: map[string][]string{"friends": {"bob@example.org"}}},
+	}}
+	password := PasswordResponse{Password: "hunter2"}
+	password.User = "alice@example.org"
+
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		require.Nil(t, setupLogging(format, &buf))
+		w := httptest.NewRecorder()
+		logf(w, "Restore: dump=%+v user=%s\n", dump, "alice@example.org")
+		logf(w, "response: %v\n", &password)
+		logf(w, "keys: %v\n", []ApiKey{{Name: "admin", Key: "key-value"}})
+		require.Nil(t, logData(w, "scan", map[string]any{"Secret": "scan-secret"}))
+		succeed(w, "password", &password)
+		logger = nil
+
+		output := buf.String()
+		for _, secret := range secrets {
+			require.NotContains(t, output, secret, format)
+		}
+		require.Contains(t, output, "bob@example.org")
+		require.Contains(t, output, redactedValue)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	LogLevelNormal  = "normal"
+	LogLevelVerbose = "verbose"
+)
+
+type LogLevelResponse struct {
+	api.Response
+	Level string
+	Trace []string
+}
+
+// verbose logging for all requests; toggled at runtime by the admin endpoint or signal
+var verboseLogging atomic.Bool
+
+// users whose requests are logged verbosely regardless of the log level
+var tracedUsers = struct {
+	sync.RWMutex
+	users map[string]bool
+}{users: map[string]bool{}}
+
+func logLevel() string {
+	if verboseLogging.Load() {
+		return LogLevelVerbose
+	}
+	return LogLevelNormal
+}
+
+func setLogLevel(level string) error {
+	var enable bool
+	switch level {
+	case LogLevelNormal:
+	case LogLevelVerbose:
+		enable = true
+	default:
+		return fmt.Errorf("unknown log level: '%s'", level)
+	}
+	// viper is read concurrently by the mabctl api, so its verbose setting
+	// keeps the startup value
+	verboseLogging.Store(enable)
+	return nil
+}
+
+func setTrace(user string, enable bool) {
+	tracedUsers.Lock()
+	defer tracedUsers.Unlock()
+	if enable {
+		tracedUsers.users[user] = true
+	} else {
+		delete(tracedUsers.users, user)
+	}
+}
+
+func isTraced(user string) bool {
+	tracedUsers.RLock()
+	defer tracedUsers.RUnlock()
+	return tracedUsers.users[user]
+}
+
+func tracedUserList() []string {
+	tracedUsers.RLock()
+	defer tracedUsers.RUnlock()
+	return sortedKeys(tracedUsers.users)
+}
+
+// enable verbose logging for the rest of this request if user is traced
+func traceRequest(w http.ResponseWriter, user string) {
+	if user == "" || !isTraced(user) {
+		return
+	}
+	if rw, ok := requestState(w); ok && !rw.trace {
+		rw.trace = true
+		logf(w, "tracing request for %s\n", user)
+	}
+}
+
+// report whether this request should log at full detail
+func isVerbose(w http.ResponseWriter) bool {
+	if verboseLogging.Load() {
+		return true
+	}
+	rw, ok := requestState(w)
+	return ok && rw.trace
+}
+
+func sendLogLevel(w http.ResponseWriter, request string) {
+	var response LogLevelResponse
+	response.User = "system"
+	response.Request = request
+	response.Success = true
+	response.Level = logLevel()
+	response.Trace = tracedUserList()
+	response.Message = fmt.Sprintf("log level %s", response.Level)
+	succeed(w, response.Message, &response)
+}
+
+func handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	sendLogLevel(w, "get log level")
+}
+
+func handlePutLogLevel(w http.ResponseWriter, r *http.Request) {
+	level := r.PathValue("level")
+	requestString := fmt.Sprintf("set log level %s", level)
+	old := logLevel()
+	err := setLogLevel(level)
+	if err != nil {
+		fail(w, "system", requestString, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logf(w, "log level changed: %s -> %s\n", old, level)
+	sendLogLevel(w, requestString)
+}
+
+func handlePutTrace(w http.ResponseWriter, r *http.Request) {
+	address := r.PathValue("address")
+	setTrace(address, true)
+	logf(w, "tracing enabled for %s\n", address)
+	sendLogLevel(w, fmt.Sprintf("trace %s", address))
+}
+
+func handleDeleteTrace(w http.ResponseWriter, r *http.Request) {
+	address := r.PathValue("address")
+	setTrace(address, false)
+	logf(w, "tracing disabled for %s\n", address)
+	sendLogLevel(w, fmt.Sprintf("untrace %s", address))
+}
+
+// toggle between normal and verbose logging
+func verboseHandler(sig os.Signal) error {
+	level := LogLevelVerbose
+	if verboseLogging.Load() {
+		level = LogLevelNormal
+	}
+	setLogLevel(level)
+	log.Printf("received verbose signal; log level %s\n", level)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	Initialize(t)
+	defer setVerbose(false)
+	require.NotNil(t, setLogLevel("loud"))
+
+	req := httptest.NewRequest("PUT", "/filterctl/loglevel/verbose/", nil)
+	result := callHandler("PUT /filterctl/loglevel/{level}/", handlePutLogLevel, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response LogLevelResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.Equal(t, LogLevelVerbose, response.Level)
+	require.Equal(t, LogLevelVerbose, logLevel())
+
+	req = httptest.NewRequest("PUT", "/filterctl/loglevel/loud/", nil)
+	result = callHandler("PUT /filterctl/loglevel/{level}/", handlePutLogLevel, req)
+	require.Equal(t, http.StatusBadRequest, result.StatusCode)
+	require.Equal(t, LogLevelVerbose, logLevel())
+
+	verboseHandler(nil)
+	require.Equal(t, LogLevelNormal, logLevel())
+}
+
+func TestTraceUser(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	setVerbose(false)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stdout)
+	server := NewServer(&activeConfig, configFile, nil)
+	server.route("GET /test/trace/class/{address}/{score}/", handleGetClass)
+	server.route("PUT /test/trace/{address}/", handlePutTrace)
+	server.route("DELETE /test/trace/{address}/", handleDeleteTrace)
+
+	serve := func(method, path string) *http.Response {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Result()
+	}
+
+	require.Equal(t, http.StatusOK, serve("PUT", "/test/trace/alice@example.org/").StatusCode)
+	require.True(t, isTraced("alice@example.org"))
+	require.Equal(t, []string{"alice@example.org"}, tracedUserList())
+
+	buf.Reset()
+	require.Equal(t, http.StatusOK, serve("GET", "/test/trace/class/bob@example.org/3/").StatusCode)
+	require.NotContains(t, buf.String(), "GET /test/trace/class/bob@example.org/3/")
+
+	buf.Reset()
+	require.Equal(t, http.StatusOK, serve("GET", "/test/trace/class/alice@example.org/3/").StatusCode)
+	require.Contains(t, buf.String(), "GET /test/trace/class/alice@example.org/3/")
+
+	buf.Reset()
+	require.Equal(t, http.StatusOK, serve("DELETE", "/test/trace/alice@example.org/").StatusCode)
+	require.False(t, isTraced("alice@example.org"))
+	// trace changes carry the request id
+	require.Regexp(t, `req=\S+ tracing disabled for alice@example.org`, buf.String())
+
+	buf.Reset()
+	require.Equal(t, http.StatusOK, serve("GET", "/test/trace/class/alice@example.org/3/").StatusCode)
+	require.NotContains(t, buf.String(), "GET /test/trace/class/alice@example.org/3/")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/rstms/mabctl/api"
@@ -11,9 +12,11 @@ import (
 	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,7 +31,6 @@ const defaultPort = 2016
 const SHUTDOWN_TIMEOUT = 5
 const Version = "1.2.9"
 
-var Verbose bool
 var Debug bool
 var InsecureSkipClientCertificateValidation bool
 var mabLock sync.Mutex
@@ -39,6 +41,8 @@ var (
 	signalFlag = flag.String("s", "", `send signal:
     stop - shutdown
     reload - reload config
+    reopen - reopen log file
+    verbose - toggle verbose logging
     `)
 	shutdown = make(chan struct{})
 	reload   = make(chan struct{})
@@ -51,7 +55,11 @@ type ClassesResponse struct {
 
 type ClassResponse struct {
 	api.Response
-	Class string
+	Class      string
+	Addresses  []string
+	DecidedBy  string
+	Default    bool
+	Recipients []RecipientClass
 }
 
 type ScanResponse struct {
@@ -93,7 +101,9 @@ type AddAddressRequest struct {
 func MAB(w http.ResponseWriter) (*api.Controller, bool) {
 	mabLock.Lock()
 	defer mabLock.Unlock()
-	api, err := api.NewAddressBookController()
+	start := time.Now()
+	api, err := requestServer(w).newController()
+	observeMAB(w, "NewAddressBookController", start, err)
 	if err != nil {
 		fail(w, "system", "address book controller", fmt.Sprintf("api init failed: %v", err), http.StatusInternalServerError)
 		return nil, false
@@ -102,103 +112,177 @@ func MAB(w http.ResponseWriter) (*api.Controller, bool) {
 }
 
 func systemFail(w http.ResponseWriter, endpoint, message string, status int) {
-	log.Printf("  [%d] %s: %s", status, endpoint, message)
+	logf(w, "  [%d] %s: %s", status, endpoint, message)
 	w.WriteHeader(status)
 }
 
 func fail(w http.ResponseWriter, user, request, message string, status int) {
-	log.Printf("  [%d] %s", status, message)
+	logf(w, "  [%d] %s", status, message)
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(api.Response{User: user, Request: request, Success: false, Message: message})
 }
 
+// fail the request with a generic 500 response after a panic or encoding error
+//
+// The cause and stack go to the log only; the client gets the request id to report.
+func internalError(w http.ResponseWriter, kind, request string, cause any) {
+	internalErrors.Inc(kind)
+	logf(w, "  [%d] %s: %v\n%s", http.StatusInternalServerError, kind, cause, debug.Stack())
+	message := "internal error"
+	if rw, ok := requestState(w); ok {
+		if rw.status != 0 {
+			// the response has started; the client sees a truncated body
+			return
+		}
+		message = fmt.Sprintf("internal error; request id %s", rw.id)
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(api.Response{User: "system", Request: request, Success: false, Message: message})
+}
+
 func succeed(w http.ResponseWriter, message string, result interface{}) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		internalError(w, "encode", message, fmt.Errorf("failure formatting response: %v", err))
+		return
+	}
 	status := http.StatusOK
-	log.Printf("  [%d] %s", status, message)
-	if Verbose {
-		dump, err := json.MarshalIndent(result, "", "  ")
-		if err != nil {
-
-			log.Fatalln("failure formatting response:", err)
+	logf(w, "  [%d] %s", status, message)
+	if isVerbose(w) {
+		if logger != nil {
+			logger.Info("response", append(requestAttrs(w), "data", redact(result))...)
+		} else {
+			dump, err := json.MarshalIndent(redact(result), "", "  ")
+			if err != nil {
+				logf(w, "failure formatting response log: %v\n", err)
+			} else {
+				logf(w, "%s", dump)
+			}
 		}
-		log.Println(string(dump))
 	}
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(result)
+	w.Write(append(data, '\n'))
 }
 
-func checkClientCert(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+// verify the client cert and api key may call endpoint; userParams name the
+// path values identifying the users acted on, checked against the key's scope
+func checkClientCert(w http.ResponseWriter, r *http.Request, endpoint string, userParams ...string) bool {
 	if InsecureSkipClientCertificateValidation {
-		log.Printf(
+		logf(w,
 			"InsecureSkipClientCertificateValidation: %v; not checking client cert",
 			InsecureSkipClientCertificateValidation,
 		)
 		return true
 	}
-	certHeader, ok := r.Header["X-Client-Cert-Dn"]
-	if !ok {
-		systemFail(w, endpoint, "missing client certificate header", http.StatusUnauthorized)
+	if peer, ok := requestPeer(r); ok {
+		return checkPeer(w, r, endpoint, peer, userParams)
+	}
+	config := requestConfig(w)
+	dn, status, err := clientCertDN(r, config.TrustedProxies)
+	if err != nil {
+		systemFail(w, endpoint, err.Error(), status)
 		return false
 	}
 
-	if Verbose {
-		log.Printf("client cert dn: %v\n", certHeader)
+	if isVerbose(w) {
+		logf(w, "client cert dn: %v\n", dn)
+	}
+
+	if rw, ok := requestState(w); ok {
+		rw.dn = dn
+	}
+
+	policy, ok := config.ClientCert(dn)
+	if !ok {
+		systemFail(w, endpoint, fmt.Sprintf("unexpected client cert CN: '%s'", dn), http.StatusUnauthorized)
+		return false
 	}
 
-	if len(certHeader) != 1 {
-		systemFail(w, endpoint, fmt.Sprintf("unexpected multiple cert header values: %v", certHeader), http.StatusBadRequest)
+	key, ok := checkApiKey(w, r, endpoint)
+	if !ok {
 		return false
 	}
 
-	switch certHeader[0] {
-	case "CN=filterctl":
-	case "CN=mabctl":
-	case "CN=filterbooks":
-	default:
-		systemFail(w, endpoint, fmt.Sprintf("unexpected client cert CN: '%s'", certHeader[0]), http.StatusUnauthorized)
+	if !policy.Permits(endpoint, r.Method) {
+		fail(w, "system", endpoint, fmt.Sprintf("client cert '%s' not permitted to call %s", policy.DN, endpoint), http.StatusForbidden)
 		return false
 	}
+	return checkApiKeyScope(w, r, endpoint, key, userParams)
+}
 
-	if !checkApiKey(w, r, endpoint) {
+// verify key may call endpoint for the users named by the userParams path values
+func checkApiKeyScope(w http.ResponseWriter, r *http.Request, endpoint string, key *ApiKey, userParams []string) bool {
+	if !key.Permits(endpoint, r.Method) {
+		fail(w, "system", endpoint, fmt.Sprintf("api key '%s' not permitted to call %s", key.Name, endpoint), http.StatusForbidden)
 		return false
 	}
+	for _, name := range userParams {
+		user := r.PathValue(name)
+		if user != "" && !key.PermitsUser(user) {
+			fail(w, user, endpoint, fmt.Sprintf("api key '%s' not permitted for user %s", key.Name, user), http.StatusForbidden)
+			return false
+		}
+	}
 	return true
 }
 
-func checkApiKey(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+func checkApiKey(w http.ResponseWriter, r *http.Request, endpoint string) (*ApiKey, bool) {
 	apiKeyHeader, ok := r.Header["X-Api-Key"]
 	if !ok {
 		systemFail(w, endpoint, "missing X-Api-Key header", http.StatusBadRequest)
-		return false
+		return nil, false
 	}
 
 	if len(apiKeyHeader) != 1 {
-		systemFail(w, endpoint, fmt.Sprintf("unexpected multiple api key header values: %v", apiKeyHeader), http.StatusBadRequest)
-		return false
+		systemFail(w, endpoint, fmt.Sprintf("unexpected multiple api key header values: %d", len(apiKeyHeader)), http.StatusBadRequest)
+		return nil, false
 	}
 
-	if apiKeyHeader[0] != viper.GetString("api_key") {
+	key, ok := requestConfig(w).MatchApiKey(apiKeyHeader[0])
+	if !ok {
 		systemFail(w, endpoint, "api key mismatch", http.StatusUnauthorized)
-		return false
+		return nil, false
 	}
-	return true
+	if rw, ok := requestState(w); ok {
+		rw.apiKey = key
+	}
+	if key.Expired() {
+		systemFail(w, endpoint, fmt.Sprintf("api key '%s' expired", key.Name), http.StatusUnauthorized)
+		return nil, false
+	}
+	return key, true
 }
 
 func logConfig(w http.ResponseWriter, config *classes.SpamClasses, label, user, request string) error {
 
-	if Verbose {
-		data, err := json.MarshalIndent(&config.Classes, "", "  ")
-		if err != nil {
-			return err
-		}
-		log.Printf("BEGIN-%s: user=%s request=%s\n%s\nEND-%s\n", label, user, request, string(data), label)
+	if isVerbose(w) {
+		return logData(w, label, &config.Classes, "user", user, "request", request)
 	}
 	return nil
 }
 
 func readConfig(w http.ResponseWriter, user, request string) (*classes.SpamClasses, bool) {
-	config, err := classes.New(configFile)
+	config, err := classes.New(requestServer(w).classesFile)
+	configReads.Inc("file")
 	if err != nil {
+		configErrors.Inc("read")
+		fail(w, user, request, "configuration read failed", http.StatusInternalServerError)
+		return nil, false
+	}
+	err = logConfig(w, config, "readConfig", user, request)
+	if err != nil {
+		msg := fmt.Sprintf("readConfig: logConfig failed: %v", err)
+		fail(w, user, request, msg, http.StatusInternalServerError)
+		return nil, false
+	}
+	return config, true
+}
+
+// return the shared cached config for read-only requests
+func readCachedConfig(w http.ResponseWriter, user, request string) (*classes.SpamClasses, bool) {
+	config, err := cachedConfig(requestServer(w).classesFile)
+	if err != nil {
+		configErrors.Inc("read")
 		fail(w, user, request, "configuration read failed", http.StatusInternalServerError)
 		return nil, false
 	}
@@ -220,8 +304,12 @@ func writeConfig(w http.ResponseWriter, config *classes.SpamClasses, user, reque
 		return false
 	}
 
-	err = config.Write(configFile)
+	err = writeConfigFile(config, requestServer(w).classesFile)
+	invalidateConfigCache()
+	configWrites.Inc()
 	if err != nil {
+		configErrors.Inc("write")
+		logf(w, "writeConfig: %v\n", err)
 		fail(w, user, request, "configuration write failed", http.StatusInternalServerError)
 		return false
 	}
@@ -239,44 +327,50 @@ func sendClasses(w http.ResponseWriter, config *classes.SpamClasses, address, re
 }
 
 func handleGetClass(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "get_class") {
-		return
-	}
 	address := r.PathValue("address")
 	scoreParam := r.PathValue("score")
+	// additional recipients may be passed as ?address=...&address=...
+	addresses := append([]string{address}, r.URL.Query()["address"]...)
 	requestString := fmt.Sprintf("classify %v", scoreParam)
-	if Verbose {
-		log.Printf("GET address=%s score=%s\n", address, scoreParam)
+	for _, recipient := range addresses[1:] {
+		if !checkUser(w, "get_class", recipient) {
+			return
+		}
 	}
 	score, err := strconv.ParseFloat(scoreParam, 32)
 	if err != nil {
 		fail(w, address, requestString, "score conversion failed", http.StatusBadRequest)
 		return
 	}
+	if !validScore(score) {
+		fail(w, address, requestString, fmt.Sprintf("invalid score: %s", scoreParam), http.StatusBadRequest)
+		return
+	}
 
-	config, ok := readConfig(w, address, requestString)
+	config, ok := readCachedConfig(w, address, requestString)
 	if ok {
 		var response ClassResponse
 		response.User = address
 		response.Request = requestString
 		response.Success = true
-		response.Class = config.GetClass([]string{address}, float32(score))
+		result := classify(config, addresses, float32(score))
+		response.Class = result.Class
+		response.Addresses = result.Addresses
+		response.DecidedBy = result.DecidedBy
+		response.Default = result.Default
+		response.Recipients = result.Recipients
+		now := time.Now()
+		for _, recipient := range result.Recipients {
+			classStats.Record(recipient.Address, recipient.Class, float32(score), now)
+		}
 		response.Message = fmt.Sprintf("%v", response.Class)
 		succeed(w, response.Message, &response)
 	}
 }
 
 func handleGetClasses(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "get_classes") {
-		return
-	}
 	address := r.PathValue("address")
 	requestString := "get classes"
-	if Verbose {
-		log.Printf("GET address=%s\n", address)
-	}
 	config, ok := readConfig(w, address, requestString)
 	if ok {
 		sendClasses(w, config, address, requestString)
@@ -284,10 +378,6 @@ func handleGetClasses(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePostClasses(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "post_classes") {
-		return
-	}
 	type PostClassesRequest struct {
 		Address string
 		Classes []classes.SpamClass
@@ -298,10 +388,18 @@ func handlePostClasses(w http.ResponseWriter, r *http.Request) {
 		fail(w, "system", "post classes", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkUser(w, "post_classes", request.Address) {
+		return
+	}
 	requestString := "post classes"
-	if Verbose {
-		log.Printf("POST address=%s classes=%v\n", request.Address, request.Classes)
+	if isVerbose(w) {
+		logf(w, "POST address=%s classes=%v\n", request.Address, request.Classes)
+	}
+	unlock, ok := lockConfig(w, request.Address, requestString)
+	if !ok {
+		return
 	}
+	defer unlock()
 	config, ok := readConfig(w, request.Address, requestString)
 	if !ok {
 		fail(w, "system", "post classes", "readConfig failed", http.StatusBadRequest)
@@ -310,161 +408,148 @@ func handlePostClasses(w http.ResponseWriter, r *http.Request) {
 	if len(request.Classes) == 0 {
 		request.Classes = config.GetClasses("default")
 	}
+	before := userClasses(config, request.Address)
 	config.SetClasses(request.Address, request.Classes)
 	if writeConfig(w, config, request.Address, requestString) {
+		auditClasses(w, request.Address, requestString, before, userClasses(config, request.Address))
 		sendClasses(w, config, request.Address, requestString)
 	}
 }
 
 func handlePutClassThreshold(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "put_class_threshold") {
-		return
-	}
 	address := r.PathValue("address")
 	name := r.PathValue("name")
 	threshold := r.PathValue("threshold")
 	requestString := fmt.Sprintf("set class %s threshold to %v", name, threshold)
-	if Verbose {
-		log.Printf("PUT address=%s name=%s threshold=%s\n", address, name, threshold)
-	}
 	score, err := strconv.ParseFloat(threshold, 32)
 	if err != nil {
 		fail(w, address, requestString, "threshold conversion failed", http.StatusBadRequest)
 		return
 	}
+	unlock, ok := lockConfig(w, address, requestString)
+	if !ok {
+		return
+	}
+	defer unlock()
 	config, ok := readConfig(w, address, requestString)
 	if !ok {
 		return
 	}
+	before := userClasses(config, address)
 	config.SetThreshold(address, name, float32(score))
 	if writeConfig(w, config, address, requestString) {
+		auditClasses(w, address, requestString, before, userClasses(config, address))
 		sendClasses(w, config, address, requestString)
 	}
 }
 
 func handleDeleteUserClasses(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "delete_user_classes") {
-		return
-	}
 	address := r.PathValue("address")
 	requestString := "delete user"
-	if Verbose {
-		log.Printf("DELETE (user) address=%s\n", address)
+	unlock, ok := lockConfig(w, address, requestString)
+	if !ok {
+		return
 	}
+	defer unlock()
 	config, ok := readConfig(w, address, requestString)
 	if !ok {
 		return
 	}
+	before := userClasses(config, address)
 	config.DeleteClasses(address)
 	if writeConfig(w, config, address, requestString) {
+		auditClasses(w, address, requestString, before, nil)
 		message := "user deleted"
 		succeed(w, message, &api.Response{User: address, Request: requestString, Success: true, Message: message})
 	}
 }
 
 func handleDeleteClass(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "delete_class") {
-		return
-	}
 	address := r.PathValue("address")
 	name := r.PathValue("name")
 	requestString := fmt.Sprintf("delete class %s", name)
-	if Verbose {
-		log.Printf("DELETE (class) address=%s name=%s\n", address, name)
+	unlock, ok := lockConfig(w, address, requestString)
+	if !ok {
+		return
 	}
+	defer unlock()
 	config, ok := readConfig(w, address, requestString)
 	if !ok {
 		return
 	}
 	config.GetClasses(address)
+	before := userClasses(config, address)
 	config.DeleteClass(address, name)
 	if writeConfig(w, config, address, requestString) {
+		auditClasses(w, address, requestString, before, userClasses(config, address))
 		sendClasses(w, config, address, requestString)
 	}
 }
 
 func handleListBooks(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "list_books") {
-		return
-	}
 	user := r.PathValue("user")
 	requestString := "list books"
-	if Verbose {
-		log.Printf("GetBooks: user=%s\n", user)
-	}
 
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
 
+	start := time.Now()
 	response, err := mab.GetBooks(user)
+	observeMAB(w, "GetBooks", start, err)
 	if err != nil {
 		fail(w, user, requestString, fmt.Sprintf("api GetBooks failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	if Verbose {
-		log.Printf("response: %+v\n", response)
+	if isVerbose(w) {
+		logf(w, "response: %+v\n", response)
 	}
 	response.User = user
 	succeed(w, response.Message, &response)
 }
 
 func handleGetAccounts(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "get_accounts") {
-		return
-	}
 	requestString := "get accounts"
-	if Verbose {
-		log.Printf("GetAccounts\n")
-	}
 
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
+	start := time.Now()
 	response, err := mab.GetAccounts()
+	observeMAB(w, "GetAccounts", start, err)
 	if err != nil {
 		fail(w, "system", requestString, fmt.Sprintf("api GetAccounts failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	if Verbose {
-		log.Printf("response: %+v\n", response)
+	if isVerbose(w) {
+		logf(w, "response: %+v\n", response)
 	}
 	succeed(w, response.Message, &response)
 }
 
 func handleGetUserDump(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "get_user_dump") {
-		return
-	}
 	user := r.PathValue("user")
 	requestString := fmt.Sprintf("dump user %s", user)
-	if Verbose {
-		log.Printf("GetUserDump user=%s\n", user)
-	}
 
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
 
+	start := time.Now()
 	apiResponse, err := mab.Dump(user)
+	observeMAB(w, "Dump", start, err)
 	if err != nil {
 		fail(w, "system", requestString, fmt.Sprintf("api Dump(%s) failed: %v", user, err), http.StatusInternalServerError)
 		return
 	}
 
-	if Verbose {
-		log.Printf("UserDump API Response: %+v\n", apiResponse)
+	if isVerbose(w) {
+		logf(w, "UserDump API Response: %+v\n", apiResponse)
 	}
 
 	config, ok := readConfig(w, user, requestString)
@@ -473,8 +558,8 @@ func handleGetUserDump(w http.ResponseWriter, r *http.Request) {
 	}
 
 	classes := config.GetClasses(user)
-	if Verbose {
-		log.Printf("UserDump Classes: %+v\n", classes)
+	if isVerbose(w) {
+		logf(w, "UserDump Classes: %+v\n", classes)
 	}
 
 	userDump := apiResponse.Dump.Users[user]
@@ -491,31 +576,34 @@ func handleGetUserDump(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAddBook(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "add_book") {
-		return
-	}
 	var request CreateBookRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		fail(w, "system", "create book", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkUser(w, "add_book", request.Username) {
+		return
+	}
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
-	if Verbose {
-		log.Printf("AddBook: user=%s name=%s description=%s\n", request.Username, request.Bookname, request.Description)
+	if isVerbose(w) {
+		logf(w, "AddBook: user=%s name=%s description=%s\n", request.Username, request.Bookname, request.Description)
 	}
 	requestString := fmt.Sprintf("create book %s", request.Bookname)
+	before := auditBookAddresses(w, mab, request.Username, request.Bookname)
+	start := time.Now()
 	response, err := mab.AddBook(request.Username, request.Bookname, request.Description)
+	observeMAB(w, "AddBook", start, err)
 	if err != nil {
 		fail(w, request.Username, requestString, fmt.Sprintf("api.AddBook failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	auditBooks(w, request.Username, requestString, before, auditBookAddresses(w, mab, request.Username, request.Bookname))
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	succeed(w, response.Message, &api.Response{User: request.Username, Request: requestString, Message: response.Message, Success: true})
 	return
@@ -523,10 +611,6 @@ func handleAddBook(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleAddUser(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "add_user") {
-		return
-	}
 	type CreateUserRequest struct {
 		Username string
 		Email    string
@@ -538,21 +622,27 @@ func handleAddUser(w http.ResponseWriter, r *http.Request) {
 		fail(w, "system", "create user", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkUser(w, "add_user", request.Username) {
+		return
+	}
 	requestString := fmt.Sprintf("create user %s", request.Username)
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
-	if Verbose {
-		log.Printf("AddUser: user=%s email=%s, password=XXXXXXXXX\n", request.Username, request.Email)
+	if isVerbose(w) {
+		logf(w, "AddUser: user=%s email=%s, password=XXXXXXXXX\n", request.Username, request.Email)
 	}
+	start := time.Now()
 	response, err := mab.AddUser(request.Username, request.Email, "")
+	observeMAB(w, "AddUser", start, err)
 	if err != nil {
 		fail(w, request.Username, requestString, fmt.Sprintf("api.AddBook failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	auditBooks(w, request.Username, requestString, nil, auditUserBooks(w, mab, request.Username))
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	succeed(w, response.Message, &api.Response{User: request.Username, Request: requestString, Message: response.Message, Success: true})
 	return
@@ -560,10 +650,6 @@ func handleAddUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePostRestore(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "post_restore") {
-		return
-	}
 	type RestoreRequest struct {
 		Username string
 		Dump     api.ConfigDump
@@ -574,27 +660,36 @@ func handlePostRestore(w http.ResponseWriter, r *http.Request) {
 		fail(w, "system", "restore user", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkUser(w, "post_restore", request.Username) {
+		return
+	}
 	requestString := fmt.Sprintf("restore user %s", request.Username)
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
-	if Verbose {
-		log.Printf("Restore: dump=%+v user=%s\n", request.Dump, request.Username)
+	if isVerbose(w) {
+		logf(w, "Restore: dump=%+v user=%s\n", request.Dump, request.Username)
 	}
 
+	before := auditUserBooks(w, mab, request.Username)
+	start := time.Now()
 	_, err = mab.DeleteUser(request.Username)
+	observeMAB(w, "DeleteUser", start, err)
 	if err != nil {
 		fail(w, request.Username, requestString, fmt.Sprintf("api.DeleteUser failed: %v", err), http.StatusBadRequest)
 	}
 
+	start = time.Now()
 	response, err := mab.Restore(&request.Dump, request.Username)
+	observeMAB(w, "Restore", start, err)
 	if err != nil {
 		fail(w, request.Username, requestString, fmt.Sprintf("api.Restore failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	auditBooks(w, request.Username, requestString, before, auditUserBooks(w, mab, request.Username))
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	response.User = request.Username
 	succeed(w, response.Message, &response)
@@ -603,56 +698,55 @@ func handlePostRestore(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleDeleteBook(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "delete_book") {
-		return
-	}
 	username := r.PathValue("user")
 	bookname := r.PathValue("book")
-	if Verbose {
-		log.Printf("DeleteBook: username=%s bookname=%s\n", username, bookname)
-	}
 	requestString := fmt.Sprintf("delete book %s", bookname)
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
+	before := auditBookAddresses(w, mab, username, bookname)
+	start := time.Now()
 	response, err := mab.DeleteBook(username, bookname)
+	observeMAB(w, "DeleteBook", start, err)
 	if err != nil {
 		fail(w, username, requestString, fmt.Sprintf("api.DeleteBook failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	auditBooks(w, username, requestString, before, auditBookAddresses(w, mab, username, bookname))
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	succeed(w, response.Message, &api.Response{User: username, Request: requestString, Message: response.Message, Success: true})
 }
 
 func handleAddAddress(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "add_address") {
-		return
-	}
 	var request AddAddressRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		fail(w, "system", "add address", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkUser(w, "add_address", request.Username) {
+		return
+	}
 	requestString := fmt.Sprintf("add %s to %s", request.Address, request.Bookname)
-	if Verbose {
-		log.Printf("AddAddress: username=%s bookname=%s address=%s name=%s\n", request.Username, request.Bookname, request.Address, request.Name)
+	if isVerbose(w) {
+		logf(w, "AddAddress: username=%s bookname=%s address=%s name=%s\n", request.Username, request.Bookname, request.Address, request.Name)
 	}
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
 
+	before := auditBookAddresses(w, mab, request.Username, request.Bookname)
 	deletedFrom := ""
-	if viper.GetBool("unique_book_addresses") {
+	if requestConfig(w).UniqueBookAddresses {
 		bookNames := make(map[string]bool)
 		// remove address from other books
+		start := time.Now()
 		response, err := mab.Dump(request.Username)
+		observeMAB(w, "Dump", start, err)
 		if err != nil {
 			fail(w, request.Username, requestString, fmt.Sprintf("api.Dump failed: %v", err), http.StatusInternalServerError)
 			return
@@ -663,13 +757,18 @@ func handleAddAddress(w http.ResponseWriter, r *http.Request) {
 				for _, address := range addresses {
 
 					if address == request.Address {
-						log.Printf("Deleting duplicate: user='%s' book='%s' address='%s'\n", request.Username, bookName, address)
+						logf(w, "Deleting duplicate: user='%s' book='%s' address='%s'\n", request.Username, bookName, address)
 
+						start = time.Now()
 						_, err := mab.DeleteAddress(request.Username, bookName, address)
+						observeMAB(w, "DeleteAddress", start, err)
 						if err != nil {
 							fail(w, request.Username, requestString, fmt.Sprintf("api.DeleteAddress failed: %v", err), http.StatusInternalServerError)
 						}
 						bookNames[bookName] = true
+						if before != nil {
+							before[bookName] = addresses
+						}
 					}
 				}
 			}
@@ -683,13 +782,16 @@ func handleAddAddress(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	start := time.Now()
 	response, err := mab.AddAddress(nil, request.Username, request.Bookname, request.Address, request.Name)
+	observeMAB(w, "AddAddress", start, err)
 	if err != nil {
 		fail(w, request.Username, requestString, fmt.Sprintf("api.AddAddress failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	auditBooks(w, request.Username, requestString, before, auditBookAddresses(w, mab, request.Username, append(sortedKeys(before), request.Bookname)...))
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	message := fmt.Sprintf("%s%s", response.Message, deletedFrom)
 	succeed(w, response.Message, &api.Response{User: request.Username, Request: requestString, Message: message, Success: true})
@@ -697,80 +799,70 @@ func handleAddAddress(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleDeleteAddress(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "delete_address") {
-		return
-	}
 	username := r.PathValue("user")
 	bookname := r.PathValue("book")
 	address := r.PathValue("address")
 	requestString := fmt.Sprintf("delete %s from %s", address, bookname)
-	if Verbose {
-		log.Printf("DeleteAddress: user=%s book=%s address=%s\n", username, bookname, address)
-	}
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
+	before := auditBookAddresses(w, mab, username, bookname)
+	start := time.Now()
 	response, err := mab.DeleteAddress(username, bookname, address)
+	observeMAB(w, "DeleteAddress", start, err)
 	if err != nil {
 		fail(w, username, requestString, fmt.Sprintf("api.DeleteAddress failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	auditBooks(w, username, requestString, before, auditBookAddresses(w, mab, username, bookname))
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	succeed(w, response.Message, &api.Response{User: username, Request: requestString, Message: response.Message, Success: true})
 	return
 }
 
 func handleListAddresses(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "list_addresses") {
-		return
-	}
 	username := r.PathValue("user")
 	bookname := r.PathValue("book")
 	requestString := fmt.Sprintf("list %s addresses", bookname)
-	if Verbose {
-		log.Printf("ListAddresses: user=%s book=%s\n", username, bookname)
-	}
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
+	start := time.Now()
 	response, err := mab.Addresses(nil, username, bookname)
+	observeMAB(w, "Addresses", start, err)
 	if err != nil {
 		fail(w, username, requestString, fmt.Sprintf("api.Addresses failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	succeed(w, response.Message, &response)
 }
 
 // return list of books containing address
 func handleScanAddress(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	// no client cert check for this endpoint
 	username := r.PathValue("user")
 	address := r.PathValue("address")
 	requestString := fmt.Sprintf("scan books for %s", address)
-	if Verbose {
-		log.Printf("ScanAddress: user=%s address=%s\n", username, address)
-	}
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
+	start := time.Now()
 	apiResponse, err := mab.ScanAddress(username, address)
+	observeMAB(w, "ScanAddress", start, err)
 	if err != nil {
+		auditScan(w, r, http.StatusInternalServerError, nil)
 		fail(w, username, requestString, fmt.Sprintf("api.ScanAddress failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", apiResponse)
+	if isVerbose(w) {
+		logf(w, "response: %v\n", apiResponse)
 	}
 	var response ScanResponse
 	response.User = username
@@ -781,30 +873,26 @@ func handleScanAddress(w http.ResponseWriter, r *http.Request) {
 	for i, book := range apiResponse.Books {
 		response.Books[i] = book.BookName
 	}
+	auditScan(w, r, http.StatusOK, response.Books)
 	succeed(w, response.Message, &response)
 }
 
 func handlePasswordRequest(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	if !checkClientCert(w, r, "get_password") {
-		return
-	}
 	username := r.PathValue("user")
 	requestString := "password lookup"
-	if Verbose {
-		log.Printf("PasswordRequest: user=%s\n", username)
-	}
 	mab, ok := MAB(w)
 	if !ok {
 		return
 	}
+	start := time.Now()
 	response, err := mab.GetPassword(username)
+	observeMAB(w, "GetPassword", start, err)
 	if err != nil {
 		fail(w, username, requestString, fmt.Sprintf("api.GetPassword failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if Verbose {
-		log.Printf("response: %v\n", response)
+	if isVerbose(w) {
+		logf(w, "response: %v\n", response)
 	}
 	if !response.Success {
 		fail(w, username, requestString, response.Message, 404)
@@ -814,48 +902,79 @@ func handlePasswordRequest(w http.ResponseWriter, r *http.Request) {
 	succeed(w, response.Message, &response)
 }
 
-func runServer(addr *string, port *int) {
+func runServer(limits *HTTPConfig) {
 
-	listen := fmt.Sprintf("%s:%d", *addr, *port)
+	handler := NewServer(&activeConfig, configFile, messageStore)
+	handler.maxBodySize = limits.MaxBodySize
 	server := http.Server{
-		Addr:        listen,
-		IdleTimeout: 5 * time.Second,
-	}
-
-	http.HandleFunc("GET /filterctl/classes/{address}/", handleGetClasses)
-	http.HandleFunc("POST /filterctl/classes/", handlePostClasses)
-	http.HandleFunc("GET /filterctl/class/{address}/{score}/", handleGetClass)
-	http.HandleFunc("PUT /filterctl/classes/{address}/{name}/{threshold}/", handlePutClassThreshold)
-	http.HandleFunc("DELETE /filterctl/classes/{address}/", handleDeleteUserClasses)
-	http.HandleFunc("DELETE /filterctl/classes/{address}/{name}/", handleDeleteClass)
-	http.HandleFunc("GET /filterctl/books/{user}/", handleListBooks)
-	http.HandleFunc("GET /filterctl/passwd/{user}/", handlePasswordRequest)
-	http.HandleFunc("GET /filterctl/addresses/{user}/{book}/", handleListAddresses)
-	http.HandleFunc("GET /filterctl/scan/{user}/{address}/", handleScanAddress)
-	http.HandleFunc("POST /filterctl/book/", handleAddBook)
-	http.HandleFunc("POST /filterctl/address/", handleAddAddress)
-	http.HandleFunc("POST /filterctl/user/", handleAddUser)
-	http.HandleFunc("GET /filterctl/accounts/", handleGetAccounts)
-	http.HandleFunc("POST /filterctl/restore/", handlePostRestore)
-	http.HandleFunc("GET /filterctl/dump/{user}/", handleGetUserDump)
-	http.HandleFunc("DELETE /filterctl/book/{user}/{book}/", handleDeleteBook)
-	http.HandleFunc("DELETE /filterctl/address/{user}/{book}/{address}/", handleDeleteAddress)
-
-	go func() {
-		mode := "daemon"
-		if Debug {
-			mode = "debug"
+		Handler:           handler,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		ConnContext:       peerConnContext,
+	}
+
+	var tlsConfig *tls.Config
+	for _, listen := range limits.Listen {
+		if listen.TLS && tlsConfig == nil {
+			var err error
+			tlsConfig, err = newTLSConfig()
+			if err != nil {
+				log.Fatalln("TLS configuration failed: ", err)
+			}
+		}
+	}
+
+	classStats.SetLimit(currentConfig().Stats.MaxUsers)
+	statsFile := currentConfig().Stats.File
+	if statsFile != "" {
+		err := classStats.Load(statsFile)
+		if err != nil {
+			log.Printf("stats: failed loading %s: %v\n", statsFile, err)
 		}
-		log.Printf("listening on %s in %s mode\n", listen, mode)
-		err := server.ListenAndServe()
+	}
+	stopStats := make(chan struct{})
+	go runStatsPersistence(stopStats)
+
+	serve := func(listener net.Listener) {
+		err := server.Serve(listener)
 		if err != nil && err != http.ErrServerClosed {
-			log.Fatalln("ListenAndServe failed: ", err)
+			log.Fatalln("Serve failed: ", err)
+		}
+	}
+	mode := "daemon"
+	if Debug {
+		mode = "debug"
+	}
+	if limits.UnixSocket.Path != "" {
+		listener, err := listenUnix(limits.UnixSocket)
+		if err != nil {
+			log.Fatalln("unix socket listen failed: ", err)
 		}
-	}()
+		log.Printf("listening on unix socket %s\n", limits.UnixSocket)
+		go serve(newLimitListener(listener, connectionSlots(limits.UnixSocket.MaxConnections)))
+	}
+	slots := connectionSlots(limits.MaxConnections)
+	for _, listen := range limits.Listen {
+		listener, err := net.Listen("tcp", listen.Address)
+		if err != nil {
+			log.Fatalln("Listen failed: ", err)
+		}
+		listener = newLimitListener(listener, slots)
+		if listen.TLS {
+			listener = tls.NewListener(listener, listen.tlsConfig(tlsConfig))
+		}
+		log.Printf("listening on %s in %s mode, max_connections=%d\n", listen, mode, limits.MaxConnections)
+		go serve(listener)
+	}
 
 	<-shutdown
 
 	log.Println("shutting down")
+	close(stopStats)
+	saveStats()
 	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT*time.Second)
 	defer cancel()
 
@@ -874,26 +993,61 @@ func stopHandler(sig os.Signal) error {
 
 func reloadHandler(sig os.Signal) error {
 	log.Println("received reload signal")
+	err := reloadConfig()
+	if err != nil {
+		log.Printf("reload failed, keeping current config: %v\n", err)
+	}
 	return nil
 }
 
 func setViperDefaults() {
+	setDefaults(viper.GetViper())
+}
+
+func setDefaults(v *viper.Viper) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatalf("failed reading my hostname: %v", err)
 	}
-	viper.SetDefault("hostname", hostname)
-	viper.SetDefault("unique_book_addresses", true)
+	v.SetDefault("hostname", hostname)
+	v.SetDefault("unique_book_addresses", true)
+	v.SetDefault("client_certs", defaultClientCertsConfig())
+	v.SetDefault("trusted_proxies", defaultTrustedProxies)
+	v.SetDefault("tls.enabled", false)
+	v.SetDefault("maildir", defaultMaildir)
+	v.SetDefault("log_format", LogFormatText)
+	v.SetDefault("log_rotate.keep", 7)
+	v.SetDefault("stats.interval", defaultStatsInterval)
+	v.SetDefault("stats.max_users", defaultStatsMaxUsers)
+	v.SetDefault("http.read_header_timeout", 10*time.Second)
+	v.SetDefault("http.read_timeout", time.Minute)
+	// long enough for a maximum length cpu profile
+	v.SetDefault("http.write_timeout", 90*time.Second)
+	v.SetDefault("http.idle_timeout", 5*time.Second)
+	v.SetDefault("http.max_header_bytes", 64<<10)
+	v.SetDefault("http.max_body_size", defaultMaxBodySize)
+	v.SetDefault("http.max_connections", 256)
+	v.SetDefault("http.rlimit_nofile", 4096)
+	v.SetDefault("unix_socket.mode", defaultUnixSocketMode)
+	v.SetDefault("unix_socket.max_connections", 32)
+	v.SetDefault("listen", defaultListen)
+}
+
+func fileLimit() (unix.Rlimit, error) {
+	var rLimit unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rLimit)
+	return rLimit, err
 }
 
 func main() {
-	addr := "127.0.0.1"
-	port := flag.Int("port", defaultPort, "listen port")
+	port := flag.Int("port", defaultPort, "default port for listen addresses without one")
+	listenFlag := flag.StringSlice("listen", nil, "listen addresses, replacing config listen (default 127.0.0.1)")
 	debugFlag := flag.Bool("debug", false, "run in foreground mode")
 	initFlag := flag.Bool("init", false, "initialize config file and exit")
 	verboseFlag := flag.Bool("verbose", false, "verbose mode")
 	configFileFlag := flag.String("config", defaultConfigFile, "rspamd class config file")
 	logFileFlag := flag.String("logfile", defaultLogFile, "log file full pathname")
+	logFormatFlag := flag.String("log-format", "", "log format: text, json or logfmt (default from config log_format)")
 	versionFlag := flag.Bool("version", false, "output version")
 	insecureFlag := flag.Bool("insecure", false, "skip client certificate validation")
 	helpFlag := flag.Bool("help", false, "show help")
@@ -915,7 +1069,7 @@ func main() {
 	}
 
 	configFile = *configFileFlag
-	Verbose = *verboseFlag
+	verboseLogging.Store(*verboseFlag)
 	Debug = *debugFlag
 	InsecureSkipClientCertificateValidation = *insecureFlag
 
@@ -939,8 +1093,7 @@ func main() {
 		}
 	}
 
-	var rLimit unix.Rlimit
-	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rLimit)
+	rLimit, err := fileLimit()
 	if err != nil {
 		log.Fatalf("failed getting resource limits: %v", err)
 	}
@@ -950,37 +1103,84 @@ func main() {
 	if InsecureSkipClientCertificateValidation {
 		log.Printf("WARNING: client certificate validation disabled\n")
 	}
-	configFileName := "/etc/filterctld/config.yaml"
+	configFileName := defaultViperConfigFile
 	viper.SetConfigFile(configFileName)
 
 	err = viper.ReadInConfig()
 	if err != nil {
 		log.Fatalf("Error reading %s: %v", configFileName, err)
 	}
-	if Verbose {
+	if *verboseFlag {
 		viper.Set("verbose", true)
 		log.Printf("classes config: %s\n", configFile)
 		log.Printf("viper config: %s\n", viper.ConfigFileUsed())
 	}
 
 	setViperDefaults()
+	logFormat := viper.GetString("log_format")
+	if *logFormatFlag != "" {
+		logFormat = *logFormatFlag
+	}
+	err = setupLogging(logFormat, os.Stderr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	config, err := newServerConfig(viper.GetViper())
+	if err != nil {
+		log.Fatalf("Error in %s: %v", configFileName, err)
+	}
+	activeConfig.Store(config)
+	if config.Scan.Auth == ScanAuthNone {
+		log.Printf("WARNING: scan endpoint authentication disabled; set scan.secret or scan.client_dn\n")
+	}
+	messageStore = NewMaildirStore(viper.GetString("maildir"))
+	if len(*listenFlag) > 0 {
+		viper.Set("listen", *listenFlag)
+	}
+	limits, err := newHTTPConfig(viper.GetViper(), *port)
+	if err != nil {
+		log.Fatalf("Error in %s: %v", configFileName, err)
+	}
+	if limits.FileLimit > uint64(rLimit.Cur) {
+		rLimit, err = raiseFileLimit(limits.FileLimit)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+		} else {
+			log.Printf("rlimit.files raised to %v\n", rLimit)
+		}
+	}
 
 	if !*debugFlag {
-		daemonize(logFileFlag, &addr, port)
+		daemonize(logFileFlag, limits)
 		os.Exit(0)
 	}
-	go runServer(&addr, port)
+	go runServer(limits)
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadHandler(sig)
+			continue
+		case syscall.SIGUSR1:
+			reopenHandler(sig)
+			continue
+		case syscall.SIGUSR2:
+			verboseHandler(sig)
+			continue
+		}
+		break
+	}
 	shutdown <- struct{}{}
 	os.Exit(0)
 }
 
-func daemonize(logFilename, addr *string, port *int) {
+func daemonize(logFilename *string, limits *HTTPConfig) {
 
 	daemon.AddCommand(daemon.StringFlag(signalFlag, "stop"), syscall.SIGTERM, stopHandler)
 	daemon.AddCommand(daemon.StringFlag(signalFlag, "reload"), syscall.SIGHUP, reloadHandler)
+	daemon.AddCommand(daemon.StringFlag(signalFlag, "reopen"), syscall.SIGUSR1, reopenHandler)
+	daemon.AddCommand(daemon.StringFlag(signalFlag, "verbose"), syscall.SIGUSR2, verboseHandler)
 
 	ctx := &daemon.Context{
 		LogFileName: *logFilename,
@@ -1008,7 +1208,9 @@ func daemonize(logFilename, addr *string, port *int) {
 	}
 	defer ctx.Release()
 
-	go runServer(addr, port)
+	daemonLogFile.Init(ctx.LogFileName, ctx.LogFilePerm)
+	go runLogRotation()
+	go runServer(limits)
 
 	err = daemon.ServeSignals()
 	if err != nil {
@@ -27,7 +27,7 @@ func Initialize(t *testing.T) {
 }
 
 func setVerbose(enable bool) {
-	Verbose = enable
+	verboseLogging.Store(enable)
 	viper.Set("verbose", enable)
 }
 
@@ -137,11 +137,9 @@ func TestAddAddress(t *testing.T) {
 	require.True(t, hasAddress(t, user, book1, addr))
 	require.False(t, hasAddress(t, user, book2, addr))
 
-	Verbose = true
-	viper.Set("verbose", true)
+	setVerbose(true)
 	addAddress(t, user, book2, addr)
-	viper.Set("verbose", false)
-	Verbose = false
+	setVerbose(false)
 
 	require.False(t, hasAddress(t, user, book1, addr))
 	require.True(t, hasAddress(t, user, book2, addr))
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minimal Prometheus text exposition format metrics
+
+var defaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var metrics []metric
+
+type Counter struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mutex.Lock()
+	c.values[key] += value
+	c.mutex.Unlock()
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), series.count)
+	}
+}
+
+// a gauge sampled when the metrics are scraped
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() (float64, bool)
+}
+
+func newGaugeFunc(name, help string, fn func() (float64, bool)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	value, ok := g.fn()
+	if !ok {
+		return
+	}
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(value))
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], quoteLabel(value)))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extraName, quoteLabel(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escape only backslash, double quote and newline, as the text exposition format specifies
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// return the number of open file descriptors
+func openFileCount() (int, error) {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		entries, err := os.ReadDir(dir)
+		if err == nil {
+			// the directory read itself holds a descriptor
+			return max(len(entries)-1, 0), nil
+		}
+	}
+	return 0, fmt.Errorf("no fd directory available")
+}
+
+var (
+	requestCount    = newCounter("filterctld_http_requests_total", "HTTP requests by route and status.", "route", "status")
+	requestDuration = newHistogram("filterctld_http_request_duration_seconds", "HTTP request latency by route.", defaultBuckets, "route")
+	mabCallDuration = newHistogram("filterctld_mab_call_duration_seconds", "Address book controller call latency.", defaultBuckets, "call")
+	mabCallErrors   = newCounter("filterctld_mab_call_errors_total", "Address book controller call errors.", "call")
+	configReads     = newCounter("filterctld_config_reads_total", "Classes config file reads by source.", "source")
+	configWrites    = newCounter("filterctld_config_writes_total", "Classes config file writes.")
+	configErrors    = newCounter("filterctld_config_errors_total", "Classes config file read and write errors.", "op")
+	internalErrors  = newCounter("filterctld_internal_errors_total", "Requests failed by a handler panic or response encoding error.", "kind")
+	_               = newGaugeFunc("filterctld_open_fds", "Open file descriptors.", openFilesGauge)
+	_               = newGaugeFunc("filterctld_max_fds", "Open file descriptor limit.", maxFilesGauge)
+	_               = newGaugeFunc("filterctld_goroutines", "Running goroutines.", goroutinesGauge)
+	_               = newGaugeFunc("filterctld_open_connections", "Accepted client connections not yet closed.", connectionsGauge)
+)
+
+func openFilesGauge() (float64, bool) {
+	count, err := openFileCount()
+	return float64(count), err == nil
+}
+
+func maxFilesGauge() (float64, bool) {
+	limit, err := fileLimit()
+	return float64(limit.Cur), err == nil
+}
+
+func connectionsGauge() (float64, bool) {
+	return float64(activeConnections.Load()), true
+}
+
+func goroutinesGauge() (float64, bool) {
+	return float64(runtime.NumGoroutine()), true
+}
+
+// record the latency and outcome of an address book api call
+func observeMAB(w http.ResponseWriter, call string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	mabCallDuration.Observe(elapsed.Seconds(), call)
+	if err != nil {
+		mabCallErrors.Inc(call)
+		logf(w, "mab %s failed after %v: %v\n", call, elapsed, err)
+	} else if isVerbose(w) {
+		logf(w, "mab %s completed in %v\n", call, elapsed)
+	}
+}
+
+func observeRequest(route string, status int, start time.Time) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requestCount.Inc(route, strconv.Itoa(status))
+	requestDuration.Observe(time.Since(start).Seconds(), route)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	server := NewServer(&activeConfig, configFile, nil)
+	server.route("GET /test/metrics/class/{address}/{score}/", handleGetClass)
+	for _, path := range []string{"/test/metrics/class/alice@example.org/3/", "/test/metrics/class/alice@example.org/x/"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	data, err := io.ReadAll(w.Result().Body)
+	require.Nil(t, err)
+	output := string(data)
+	for _, expected := range []string{
+		"# TYPE filterctld_http_requests_total counter",
+		`filterctld_http_requests_total{route="GET /test/metrics/class/{address}/{score}/",status="200"} 1`,
+		`filterctld_http_requests_total{route="GET /test/metrics/class/{address}/{score}/",status="400"} 1`,
+		`filterctld_http_request_duration_seconds_bucket{route="GET /test/metrics/class/{address}/{score}/",le="+Inf"} 2`,
+		`filterctld_http_request_duration_seconds_count{route="GET /test/metrics/class/{address}/{score}/"} 2`,
+		"# TYPE filterctld_goroutines gauge",
+		"# TYPE filterctld_config_writes_total counter",
+	} {
+		require.Contains(t, output, expected)
+	}
+	require.True(t, strings.HasSuffix(output, "\n"))
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{name: "test_seconds", help: "Test.", buckets: []float64{1, 2}, series: make(map[string]*histogramSeries)}
+	h.Observe(0.5)
+	h.Observe(1.5)
+	h.Observe(3)
+	var output strings.Builder
+	h.writeTo(&output)
+	require.Equal(t, `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="2"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5
+test_seconds_count 3
+`, output.String())
+}
+
+func TestQuoteLabel(t *testing.T) {
+	require.Equal(t, `"plain"`, quoteLabel("plain"))
+	require.Equal(t, `"a\\b\"c\nd"`, quoteLabel("a\\b\"c\nd"))
+	// other characters pass through unescaped
+	require.Equal(t, "\"café\tx\"", quoteLabel("café\tx"))
+}
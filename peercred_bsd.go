@@ -0,0 +1,39 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+const peerCredSupported = true
+
+// read LOCAL_PEERCRED; the xucred has no pid, so Pid is zero except where
+// LOCAL_PEERPID provides it
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var xucred *unix.Xucred
+	var pid int
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		xucred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if credErr == nil {
+			pid = peerPid(int(fd))
+		}
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cred := PeerCred{Uid: xucred.Uid, Pid: int32(pid)}
+	if xucred.Ngroups > 0 {
+		cred.Gid = xucred.Groups[0]
+	}
+	return &cred, nil
+}
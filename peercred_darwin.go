@@ -0,0 +1,13 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func peerPid(fd int) int {
+	pid, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+const peerCredSupported = true
+
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCred{Uid: ucred.Uid, Gid: ucred.Gid, Pid: ucred.Pid}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+const peerCredSupported = true
+
+// read SO_PEERCRED into struct sockpeercred { uid_t; gid_t; pid_t }
+//
+// x/sys/unix has no accessor for it, and raw syscalls are refused on
+// OpenBSD, so the libc getsockopt wrapper for the 20 byte IPv6Mreq is used
+// as a buffer; the kernel copies the 12 byte struct into its start.
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var buffer *unix.IPv6Mreq
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		buffer, credErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cred := buffer.Multiaddr[:]
+	return &PeerCred{
+		Uid: binary.NativeEndian.Uint32(cred[0:4]),
+		Gid: binary.NativeEndian.Uint32(cred[4:8]),
+		Pid: int32(binary.NativeEndian.Uint32(cred[8:12])),
+	}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !openbsd && !freebsd && !darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// no peer credential accessor here; listenUnix refuses to create the socket
+const peerCredSupported = false
+
+func peerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, fmt.Errorf("peer credentials not supported on %s", runtime.GOOS)
+}
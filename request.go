@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// per-request state carried through the handlers with the ResponseWriter
+type requestWriter struct {
+	http.ResponseWriter
+	id     string
+	dn     string
+	apiKey *ApiKey
+	peer   *PeerPolicy
+	status int
+	trace  bool
+	server *Server
+}
+
+func (rw *requestWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *requestWriter) Write(data []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+func requestState(w http.ResponseWriter) (*requestWriter, bool) {
+	rw, ok := w.(*requestWriter)
+	return rw, ok
+}
+
+// verify the api key and unix socket peer authenticating this request may act on user
+func checkUser(w http.ResponseWriter, endpoint, user string) bool {
+	traceRequest(w, user)
+	rw, ok := requestState(w)
+	if !ok {
+		return true
+	}
+	if rw.peer != nil && !rw.peer.PermitsUser(user) {
+		fail(w, user, endpoint, fmt.Sprintf("peer '%s' not permitted for user %s", rw.peer.User, user), http.StatusForbidden)
+		return false
+	}
+	if rw.apiKey != nil && !rw.apiKey.PermitsUser(user) {
+		fail(w, user, endpoint, fmt.Sprintf("api key '%s' not permitted for user %s", rw.apiKey.Name, user), http.StatusForbidden)
+		return false
+	}
+	return true
+}
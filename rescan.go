@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/rspamd-classes/classes"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultMaildir = "/home/{user}/Maildir"
+const spamScoreHeader = "X-Spam-Score"
+const spamClassHeader = "X-Spam-Class"
+
+// a message as returned by a MessageStore; Error is set if it could not be read
+type StoredMessage struct {
+	MessageId string
+	Header    mail.Header
+	Error     string
+}
+
+// access to the messages in a user's mail folders
+type MessageStore interface {
+	// return the messages in folder matching the message ids; ids not found are omitted
+	Messages(username, folder string, messageIds []string) ([]StoredMessage, error)
+}
+
+var messageStore MessageStore
+
+type RescanResult struct {
+	MessageId string
+	Score     float32
+	OldClass  string
+	NewClass  string
+	Changed   bool
+	Error     string `json:",omitempty"`
+}
+
+type RescanResponse struct {
+	api.Response
+	Results []RescanResult
+}
+
+// MessageStore reading Maildir++ folders from the local filesystem
+//
+// The path template may contain {user} (the local part of the username)
+// and {address} (the full username).  With {user}, addresses differing only
+// in domain share one maildir; hosts serving several domains should use
+// {address}.
+type MaildirStore struct {
+	PathTemplate string
+}
+
+func NewMaildirStore(pathTemplate string) *MaildirStore {
+	if pathTemplate == "" {
+		pathTemplate = defaultMaildir
+	}
+	return &MaildirStore{PathTemplate: pathTemplate}
+}
+
+// return the maildir path for a user's folder
+//
+// The username may not contain path separators or "..", and the result must
+// stay under the fixed directory of the template before any placeholder.
+func (m *MaildirStore) folderPath(username, folder string) (string, error) {
+	local, _, _ := strings.Cut(username, "@")
+	if local == "" || strings.ContainsAny(username, "/\\") || strings.Contains(username, "..") || strings.HasPrefix(local, ".") {
+		return "", fmt.Errorf("invalid username: '%s'", username)
+	}
+	if strings.Contains(folder, "..") || strings.ContainsAny(folder, "\\") {
+		return "", fmt.Errorf("invalid folder: '%s'", folder)
+	}
+	path := strings.ReplaceAll(m.PathTemplate, "{user}", local)
+	path = strings.ReplaceAll(path, "{address}", username)
+	if folder != "" && !strings.EqualFold(folder, "INBOX") {
+		path = filepath.Join(path, "."+strings.ReplaceAll(folder, "/", "."))
+	}
+	prefix, _, _ := strings.Cut(m.PathTemplate, "{")
+	rel, err := filepath.Rel(filepath.Dir(prefix), filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid maildir path for '%s': %s", username, path)
+	}
+	return path, nil
+}
+
+// return the messages matching messageIds
+//
+// An id may also be a maildir unique name, the filename before any ':2,'
+// flags, which is matched without reading the file.  Remaining ids are found
+// by reading headers until all are matched.  Unreadable messages are logged
+// and skipped, or returned with Error set if matched by filename.
+func (m *MaildirStore) Messages(username, folder string, messageIds []string) ([]StoredMessage, error) {
+	path, err := m.folderPath(username, folder)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(messageIds))
+	for _, id := range messageIds {
+		wanted[normalizeMessageId(id)] = true
+	}
+	files := []string{}
+	for _, subdir := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(path, subdir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed reading folder %s: %v", folder, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, subdir, entry.Name()))
+			}
+		}
+	}
+	messages := []StoredMessage{}
+	unmatched := []string{}
+	for _, file := range files {
+		unique, _, _ := strings.Cut(filepath.Base(file), ":")
+		if !wanted[unique] {
+			unmatched = append(unmatched, file)
+			continue
+		}
+		delete(wanted, unique)
+		message := StoredMessage{MessageId: unique}
+		message.Header, err = readMessageHeader(file)
+		if err != nil {
+			message.Error = err.Error()
+		}
+		messages = append(messages, message)
+	}
+	for _, file := range unmatched {
+		if len(wanted) == 0 {
+			break
+		}
+		header, err := readMessageHeader(file)
+		if err != nil {
+			log.Printf("rescan %s %s: skipping %v\n", username, folder, err)
+			continue
+		}
+		id := normalizeMessageId(header.Get("Message-Id"))
+		if wanted[id] {
+			messages = append(messages, StoredMessage{MessageId: id, Header: header})
+			delete(wanted, id)
+		}
+	}
+	return messages, nil
+}
+
+func readMessageHeader(filename string) (mail.Header, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening message: %v", err)
+	}
+	defer file.Close()
+	message, err := mail.ReadMessage(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing message %s: %v", filepath.Base(filename), err)
+	}
+	return message.Header, nil
+}
+
+func normalizeMessageId(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// reclassify a stored message using its recorded spam score
+func rescanMessage(config *classes.SpamClasses, username string, message StoredMessage) RescanResult {
+	result := RescanResult{MessageId: message.MessageId}
+	if message.Error != "" {
+		result.Error = message.Error
+		return result
+	}
+	result.OldClass = message.Header.Get(spamClassHeader)
+	scoreHeader := message.Header.Get(spamScoreHeader)
+	if scoreHeader == "" {
+		result.Error = fmt.Sprintf("missing %s header", spamScoreHeader)
+		return result
+	}
+	// rspamd may append the required score: '7.5 / 15.0'
+	scoreField, _, _ := strings.Cut(scoreHeader, "/")
+	score, err := strconv.ParseFloat(strings.TrimSpace(scoreField), 32)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid %s header: '%s'", spamScoreHeader, scoreHeader)
+		return result
+	}
+	result.Score = float32(score)
+	result.NewClass = config.GetClass([]string{username}, result.Score)
+	result.Changed = result.NewClass != result.OldClass
+	return result
+}
+
+func handlePostRescan(w http.ResponseWriter, r *http.Request) {
+	var request RescanRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		fail(w, "system", "rescan", fmt.Sprintf("failed decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !checkUser(w, "post_rescan", request.Username) {
+		return
+	}
+	requestString := fmt.Sprintf("rescan %s", request.Folder)
+	if isVerbose(w) {
+		logf(w, "Rescan: user=%s folder=%s messageIds=%v\n", request.Username, request.Folder, request.MessageIds)
+	}
+	messageStore := requestServer(w).messageStore
+	if messageStore == nil {
+		fail(w, request.Username, requestString, "message store not configured", http.StatusInternalServerError)
+		return
+	}
+	messages, err := messageStore.Messages(request.Username, request.Folder, request.MessageIds)
+	if err != nil {
+		fail(w, request.Username, requestString, fmt.Sprintf("message store failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	config, ok := readConfig(w, request.Username, requestString)
+	if !ok {
+		return
+	}
+
+	found := make(map[string]StoredMessage, len(messages))
+	for _, message := range messages {
+		found[message.MessageId] = message
+	}
+	var response RescanResponse
+	response.User = request.Username
+	response.Request = requestString
+	response.Success = true
+	response.Results = []RescanResult{}
+	changed := 0
+	for _, id := range request.MessageIds {
+		message, ok := found[normalizeMessageId(id)]
+		if !ok {
+			response.Results = append(response.Results, RescanResult{MessageId: normalizeMessageId(id), Error: "message not found"})
+			continue
+		}
+		result := rescanMessage(config, request.Username, message)
+		if result.Changed {
+			changed++
+		}
+		response.Results = append(response.Results, result)
+	}
+	response.Message = fmt.Sprintf("rescanned %d messages, %d changed", len(messages), changed)
+	succeed(w, response.Message, &response)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func initClassesFile(t *testing.T) {
+	configFile = filepath.Join(t.TempDir(), "classes.json")
+	config, err := classes.New("")
+	require.Nil(t, err)
+	config.SetClasses("alice@example.org", []classes.SpamClass{{Name: "ham", Score: 8}, {Name: "probable", Score: 11}, {Name: "spam", Score: 999}})
+	err = config.Write(configFile)
+	require.Nil(t, err)
+}
+
+func TestMaildirStore(t *testing.T) {
+	store := NewMaildirStore("testdata/maildir/{user}")
+	messages, err := store.Messages("alice@example.org", "INBOX", []string{"<ham-1@example.org>", "probable-1@example.org", "missing@example.org"})
+	require.Nil(t, err)
+	require.Len(t, messages, 2)
+	messages, err = store.Messages("alice@example.org", "Junk", []string{"spam-1@example.org"})
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, "spam", messages[0].Header.Get(spamClassHeader))
+	_, err = store.Messages("alice@example.org", "../bob", []string{"spam-1@example.org"})
+	require.NotNil(t, err)
+
+	store = NewMaildirStore("/var/mail/{address}/Maildir")
+	path, err := store.folderPath("alice@example.org", "Junk")
+	require.Nil(t, err)
+	require.Equal(t, "/var/mail/alice@example.org/Maildir/.Junk", path)
+	for _, username := range []string{"alice@x/../../bob", "alice@..", "alice@x\\y", ".alice@example.org", "@example.org"} {
+		_, err = store.folderPath(username, "INBOX")
+		require.NotNil(t, err, username)
+	}
+}
+
+func TestMaildirStoreUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	for _, subdir := range []string{"cur", "new"} {
+		require.Nil(t, os.Mkdir(filepath.Join(dir, subdir), 0700))
+	}
+	good, err := os.ReadFile("testdata/maildir/alice/cur/1700000000.M1P1.test:2,S")
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "cur", "1700000002.M3P1.test:2,S"), good, 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "new", "1700000003.M4P1.test"), []byte("not a message\n"), 0600))
+
+	store := NewMaildirStore(dir)
+	// an unparsable file does not fail the lookup of other messages
+	messages, err := store.Messages("alice@example.org", "INBOX", []string{"ham-1@example.org"})
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	require.Empty(t, messages[0].Error)
+
+	// unique names match without parsing, and report the parse error per message
+	messages, err = store.Messages("alice@example.org", "INBOX", []string{"1700000002.M3P1.test", "1700000003.M4P1.test"})
+	require.Nil(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "ham", messages[0].Header.Get(spamClassHeader))
+	require.Equal(t, "1700000003.M4P1.test", messages[1].MessageId)
+	require.NotEmpty(t, messages[1].Error)
+}
+
+func TestRescan(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	messageStore = NewMaildirStore("testdata/maildir/{user}")
+	request := RescanRequest{
+		Username:   "alice@example.org",
+		Folder:     "INBOX",
+		MessageIds: []string{"<ham-1@example.org>", "<probable-1@example.org>", "<missing@example.org>"},
+	}
+	req := httptest.NewRequest("POST", "/filterctl/rescan/", requestBuffer(t, &request))
+	result := callHandler("POST /filterctl/rescan/", handlePostRescan, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response RescanResponse
+	err := json.NewDecoder(result.Body).Decode(&response)
+	require.Nil(t, err)
+	require.True(t, response.Success)
+	require.Len(t, response.Results, 3)
+
+	require.Equal(t, "ham", response.Results[0].OldClass)
+	require.Equal(t, "ham", response.Results[0].NewClass)
+	require.False(t, response.Results[0].Changed)
+
+	require.Equal(t, float32(7), response.Results[1].Score)
+	require.Equal(t, "probable", response.Results[1].OldClass)
+	require.Equal(t, "ham", response.Results[1].NewClass)
+	require.True(t, response.Results[1].Changed)
+
+	require.Equal(t, "missing@example.org", response.Results[2].MessageId)
+	require.NotEmpty(t, response.Results[2].Error)
+}
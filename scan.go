@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/spf13/viper"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	ScanAuthNone   = "none"
+	ScanAuthSecret = "secret"
+	ScanAuthCert   = "cert"
+)
+
+// authentication, rate limit and audit settings for the scan endpoint
+//
+// The rspamd filter calls scan for every message, so it has a cheaper
+// credential than the api key plus client cert required elsewhere.  Auth
+// defaults from whichever of Secret and ClientDN is set; leaving the
+// endpoint open requires an explicit auth of none.  The rate limit applies
+// to each peer separately, before its credential is checked, and its state
+// survives reloads that leave the rate settings unchanged.
+type ScanConfig struct {
+	Auth      string
+	Secret    string
+	ClientDN  string
+	RateLimit float64
+	Burst     int
+	AuditLog  string
+	limiter   *peerRateLimiter
+}
+
+func newScanConfig(v *viper.Viper) (*ScanConfig, error) {
+	config := ScanConfig{
+		Auth:      v.GetString("scan.auth"),
+		Secret:    v.GetString("scan.secret"),
+		ClientDN:  v.GetString("scan.client_dn"),
+		RateLimit: v.GetFloat64("scan.rate_limit"),
+		Burst:     v.GetInt("scan.burst"),
+		AuditLog:  v.GetString("scan.audit_log"),
+	}
+	if config.Auth == "" {
+		switch {
+		case config.Secret != "":
+			config.Auth = ScanAuthSecret
+		case config.ClientDN != "":
+			config.Auth = ScanAuthCert
+		default:
+			return nil, fmt.Errorf("scan endpoint unauthenticated; set scan.secret, scan.client_dn or scan.auth: none")
+		}
+	}
+	switch config.Auth {
+	case ScanAuthNone:
+	case ScanAuthSecret:
+		if config.Secret == "" {
+			return nil, fmt.Errorf("scan.auth is secret but scan.secret is not set")
+		}
+	case ScanAuthCert:
+		if config.ClientDN == "" {
+			return nil, fmt.Errorf("scan.auth is cert but scan.client_dn is not set")
+		}
+	default:
+		return nil, fmt.Errorf("unknown scan.auth: '%s'", config.Auth)
+	}
+	if config.ClientDN != "" {
+		var err error
+		config.ClientDN, err = configuredDN(config.ClientDN)
+		if err != nil {
+			return nil, fmt.Errorf("scan.client_dn: %v", err)
+		}
+	}
+	if config.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid scan.rate_limit: %v", config.RateLimit)
+	}
+	if config.RateLimit > 0 {
+		burst := max(config.Burst, 1)
+		config.limiter = newPeerRateLimiter(config.RateLimit, burst)
+	}
+	return &config, nil
+}
+
+// keep the rate limiter state of old when the rate settings are unchanged
+func (c *ScanConfig) inheritLimiter(old *ScanConfig) {
+	if old == nil || old.limiter == nil || c.limiter == nil {
+		return
+	}
+	if old.RateLimit == c.RateLimit && max(old.Burst, 1) == max(c.Burst, 1) {
+		c.limiter = old.limiter
+	}
+}
+
+func (c ScanConfig) String() string {
+	return fmt.Sprintf("auth=%s client_dn=%s rate_limit=%v burst=%d audit_log=%s", c.Auth, c.ClientDN, c.RateLimit, c.Burst, c.AuditLog)
+}
+
+// token bucket limiter
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (l *rateLimiter) Allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// peers tracked before idle limiters are pruned
+const maxRateLimitPeers = 1024
+
+// a token bucket for each peer
+type peerRateLimiter struct {
+	mutex sync.Mutex
+	rate  float64
+	burst int
+	peers map[string]*rateLimiter
+}
+
+func newPeerRateLimiter(rate float64, burst int) *peerRateLimiter {
+	return &peerRateLimiter{rate: rate, burst: burst, peers: map[string]*rateLimiter{}}
+}
+
+func (l *peerRateLimiter) Allow(peer string) bool {
+	l.mutex.Lock()
+	limiter, ok := l.peers[peer]
+	if !ok {
+		if len(l.peers) >= maxRateLimitPeers {
+			l.prune()
+		}
+		limiter = newRateLimiter(l.rate, l.burst)
+		l.peers[peer] = limiter
+	}
+	l.mutex.Unlock()
+	return limiter.Allow()
+}
+
+// drop the limiters refilled to their burst, which behave as new ones
+func (l *peerRateLimiter) prune() {
+	now := time.Now()
+	for peer, limiter := range l.peers {
+		limiter.mutex.Lock()
+		full := limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate >= limiter.burst
+		limiter.mutex.Unlock()
+		if full {
+			delete(l.peers, peer)
+		}
+	}
+}
+
+// identify the scan client for rate limiting: the unix socket uid or remote host
+func scanPeer(r *http.Request) string {
+	if peer, ok := requestPeer(r); ok {
+		return fmt.Sprintf("uid=%d", peer.Uid)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// apply the rate limit of the peer, then authenticate a scan request
+//
+// Limiting first makes failed secret guesses drain the peer's bucket too.
+func checkScanAuth(w http.ResponseWriter, r *http.Request) bool {
+	config := requestConfig(w).Scan
+	reject := func(message string, status int) bool {
+		auditScan(w, r, status, nil)
+		systemFail(w, "scan_address", message, status)
+		return false
+	}
+	if config.limiter != nil && !config.limiter.Allow(scanPeer(r)) {
+		return reject("rate limit exceeded", http.StatusTooManyRequests)
+	}
+	// a unix socket peer permitted scan_address needs no other credential
+	peerAuthorized := false
+	if peer, ok := requestPeer(r); ok {
+		policy, ok := requestConfig(w).Peer(peer.Uid)
+		peerAuthorized = ok && policy.Permits("scan_address", r.Method)
+	}
+	switch {
+	case peerAuthorized:
+	case config.Auth == ScanAuthSecret:
+		secret := r.Header.Get("X-Scan-Secret")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(config.Secret)) != 1 {
+			return reject("scan secret mismatch", http.StatusUnauthorized)
+		}
+	case config.Auth == ScanAuthCert:
+		dn, status, err := clientCertDN(r, requestConfig(w).TrustedProxies)
+		if err != nil {
+			return reject(err.Error(), status)
+		}
+		if dn != config.ClientDN {
+			return reject(fmt.Sprintf("unexpected client cert CN: '%s'", dn), http.StatusUnauthorized)
+		}
+	}
+	return true
+}
+
+type ScanAuditEntry struct {
+	Time    time.Time
+	Peer    string
+	User    string
+	Address string
+	Status  int
+	Books   []string
+}
+
+var scanAudit = jsonLog{label: "scan audit"}
+
+func auditScan(w http.ResponseWriter, r *http.Request, status int, books []string) {
+	scanAudit.Write(requestConfig(w).Scan.AuditLog, &ScanAuditEntry{
+		Time:    time.Now(),
+		Peer:    r.RemoteAddr,
+		User:    r.PathValue("user"),
+		Address: r.PathValue("address"),
+		Status:  status,
+		Books:   books,
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func scanStatus(t *testing.T, secret string) int {
+	return scanPeerStatus(t, secret, "192.0.2.1:40000")
+}
+
+func scanPeerStatus(t *testing.T, secret, remoteAddr string) int {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /filterctl/scan/{user}/{address}/", func(w http.ResponseWriter, r *http.Request) {
+		if checkScanAuth(w, r) {
+			auditScan(w, r, http.StatusOK, []string{"friends"})
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	req := httptest.NewRequest("GET", "/filterctl/scan/alice@example.org/bob@example.org/", nil)
+	req.RemoteAddr = remoteAddr
+	if secret != "" {
+		req.Header.Set("X-Scan-Secret", secret)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w.Result().StatusCode
+}
+
+func TestScanAuth(t *testing.T) {
+	Initialize(t)
+	defer activeConfig.Store(nil)
+	auditFile := filepath.Join(t.TempDir(), "scan.log")
+	v := viper.New()
+	v.Set("scan.secret", "filtersecret")
+	v.Set("scan.rate_limit", 0.001)
+	v.Set("scan.burst", 2)
+	v.Set("scan.audit_log", auditFile)
+	config, err := newScanConfig(v)
+	require.Nil(t, err)
+	require.Equal(t, ScanAuthSecret, config.Auth)
+	activeConfig.Store(&ServerConfig{Scan: config})
+
+	// failed authentication drains the bucket, so guesses are limited too
+	require.Equal(t, http.StatusUnauthorized, scanStatus(t, "wrong"))
+	require.Equal(t, http.StatusOK, scanStatus(t, "filtersecret"))
+	require.Equal(t, http.StatusTooManyRequests, scanStatus(t, "wrong"))
+	require.Equal(t, http.StatusTooManyRequests, scanStatus(t, "filtersecret"))
+	// each peer has its own bucket
+	require.Equal(t, http.StatusOK, scanPeerStatus(t, "filtersecret", "192.0.2.2:40000"))
+
+	// a reload with the same rate settings keeps the buckets
+	reloaded, err := newScanConfig(v)
+	require.Nil(t, err)
+	reloaded.inheritLimiter(config)
+	require.Same(t, config.limiter, reloaded.limiter)
+	v.Set("scan.burst", 3)
+	changed, err := newScanConfig(v)
+	require.Nil(t, err)
+	changed.inheritLimiter(config)
+	require.NotSame(t, config.limiter, changed.limiter)
+	v.Set("scan.burst", 2)
+
+	file, err := os.Open(auditFile)
+	require.Nil(t, err)
+	defer file.Close()
+	statuses := []int{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry ScanAuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		require.Nil(t, err)
+		require.Equal(t, "alice@example.org", entry.User)
+		require.Equal(t, "bob@example.org", entry.Address)
+		statuses = append(statuses, entry.Status)
+	}
+	require.Equal(t, []int{401, 200, 429, 429, 200}, statuses)
+
+	v = viper.New()
+	v.Set("scan.auth", ScanAuthCert)
+	_, err = newScanConfig(v)
+	require.NotNil(t, err)
+
+	// an open scan endpoint must be configured explicitly
+	_, err = newScanConfig(viper.New())
+	require.NotNil(t, err)
+	v = viper.New()
+	v.Set("scan.auth", ScanAuthNone)
+	config, err = newScanConfig(v)
+	require.Nil(t, err)
+	require.Equal(t, ScanAuthNone, config.Auth)
+}
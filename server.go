@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/rstms/mabctl/api"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// wraps a handler with one step of request processing
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// an API server with its own routes, config and dependencies
+//
+// The daemon runs one Server sharing activeConfig so reloads apply to it;
+// tests may build any number of independent servers.
+type Server struct {
+	mux           *http.ServeMux
+	config        *atomic.Pointer[ServerConfig]
+	classesFile   string
+	messageStore  MessageStore
+	newController func() (*api.Controller, error)
+	maxBodySize   int64
+	ready         readyCache
+}
+
+func NewServer(config *atomic.Pointer[ServerConfig], classesFile string, store MessageStore) *Server {
+	s := &Server{
+		mux:           http.NewServeMux(),
+		config:        config,
+		classesFile:   classesFile,
+		messageStore:  store,
+		newController: api.NewAddressBookController,
+		maxBodySize:   defaultMaxBodySize,
+	}
+	s.routes()
+	return s
+}
+
+func (s *Server) routes() {
+	s.route("GET /filterctl/classes/{address}/", handleGetClasses, requireClientCert("get_classes", "address"))
+	s.route("POST /filterctl/classes/", handlePostClasses, requireClientCert("post_classes"))
+	s.route("GET /filterctl/class/{address}/{score}/", handleGetClass, requireClientCert("get_class", "address"))
+	s.route("PUT /filterctl/classes/{address}/{name}/{threshold}/", handlePutClassThreshold, requireClientCert("put_class_threshold", "address"))
+	s.route("DELETE /filterctl/classes/{address}/", handleDeleteUserClasses, requireClientCert("delete_user_classes", "address"))
+	s.route("DELETE /filterctl/classes/{address}/{name}/", handleDeleteClass, requireClientCert("delete_class", "address"))
+	s.route("GET /filterctl/books/{user}/", handleListBooks, requireClientCert("list_books", "user"))
+	s.route("GET /filterctl/passwd/{user}/", handlePasswordRequest, requireClientCert("get_password", "user"))
+	s.route("GET /filterctl/addresses/{user}/{book}/", handleListAddresses, requireClientCert("list_addresses", "user"))
+	// the rspamd filter authenticates with the lighter scan credential
+	s.route("GET /filterctl/scan/{user}/{address}/", handleScanAddress, requireScanAuth)
+	s.route("POST /filterctl/book/", handleAddBook, requireClientCert("add_book"))
+	s.route("POST /filterctl/address/", handleAddAddress, requireClientCert("add_address"))
+	s.route("POST /filterctl/user/", handleAddUser, requireClientCert("add_user"))
+	s.route("GET /filterctl/accounts/", handleGetAccounts, requireClientCert("get_accounts"))
+	s.route("POST /filterctl/restore/", handlePostRestore, requireClientCert("post_restore"))
+	s.route("GET /filterctl/dump/{user}/", handleGetUserDump, requireClientCert("get_user_dump", "user"))
+	s.route("DELETE /filterctl/book/{user}/{book}/", handleDeleteBook, requireClientCert("delete_book", "user"))
+	s.route("DELETE /filterctl/address/{user}/{book}/{address}/", handleDeleteAddress, requireClientCert("delete_address", "user"))
+	s.route("POST /filterctl/rescan/", handlePostRescan, requireClientCert("post_rescan"))
+	s.route("POST /filterctl/classify/", handlePostClassify, requireClientCert("post_classify"))
+	s.route("GET /metrics", handleMetrics)
+	s.route("GET /filterctl/health", handleGetHealth)
+	s.route("GET /filterctl/ready", handleGetReady)
+	s.route("GET /filterctl/status", handleGetStatus, requireClientCert("get_status"))
+	s.route("GET /filterctl/stats/{address}/", handleGetStats, requireClientCert("get_stats", "address"))
+	s.route("GET /filterctl/debug/pprof/", pprofHandler(pprof.Index), requireDebug("debug_pprof"))
+	s.route("GET /filterctl/debug/pprof/cmdline", pprofHandler(pprof.Cmdline), requireDebug("debug_pprof"))
+	s.route("GET /filterctl/debug/pprof/profile", pprofHandler(pprof.Profile), requireDebug("debug_pprof"))
+	s.route("GET /filterctl/debug/pprof/symbol", pprofHandler(pprof.Symbol), requireDebug("debug_pprof"))
+	s.route("POST /filterctl/debug/pprof/symbol", pprofHandler(pprof.Symbol), requireDebug("debug_pprof"))
+	s.route("GET /filterctl/debug/pprof/trace", pprofHandler(pprof.Trace), requireDebug("debug_pprof"))
+	s.route("GET /filterctl/debug/fds", handleGetFds, requireDebug("debug_fds"))
+	s.route("GET /filterctl/loglevel/", handleGetLogLevel, requireClientCert("get_log_level"))
+	s.route("PUT /filterctl/loglevel/{level}/", handlePutLogLevel, requireClientCert("put_log_level"))
+	s.route("PUT /filterctl/trace/{address}/", handlePutTrace, requireClientCert("put_trace", "address"))
+	s.route("DELETE /filterctl/trace/{address}/", handleDeleteTrace, requireClientCert("delete_trace", "address"))
+}
+
+// register handler behind the common middleware and then the route's own, outermost first
+func (s *Server) route(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	common := []Middleware{s.withRequestState(pattern), recoverPanic, s.limitBody, logRequest}
+	s.mux.HandleFunc(pattern, chain(handler, append(common, middleware...)...))
+}
+
+func chain(handler http.HandlerFunc, middleware ...Middleware) http.HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// return the active config, falling back to the process config if none has been stored
+func (s *Server) Config() *ServerConfig {
+	config := s.config.Load()
+	if config != nil {
+		return config
+	}
+	return currentConfig()
+}
+
+// return the server handling this request
+//
+// Handlers called directly rather than through a Server, as in tests, get
+// one built from the process globals.
+func requestServer(w http.ResponseWriter) *Server {
+	rw, ok := requestState(w)
+	if ok && rw.server != nil {
+		return rw.server
+	}
+	return &Server{
+		config:        &activeConfig,
+		classesFile:   configFile,
+		messageStore:  messageStore,
+		newController: api.NewAddressBookController,
+	}
+}
+
+func requestConfig(w http.ResponseWriter) *ServerConfig {
+	return requestServer(w).Config()
+}
+
+// attach per-request state, close the body and record the request metrics
+func (s *Server) withRequestState(route string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			start := time.Now()
+			rw := &requestWriter{ResponseWriter: w, id: requestId(r), server: s}
+			w.Header().Set("X-Request-Id", rw.id)
+			traceRequest(rw, r.PathValue("user"))
+			traceRequest(rw, r.PathValue("address"))
+			next(rw, r)
+			observeRequest(route, rw.status, start)
+		}
+	}
+}
+
+// log a panicking handler's stack and fail the request instead of the process
+func recoverPanic(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			internalError(w, "panic", r.Method+" "+r.URL.Path, value)
+		}()
+		next(w, r)
+	}
+}
+
+func limitBody(limit int64) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next(w, r)
+		}
+	}
+}
+
+// limit request bodies to the server's configured maximum
+func (s *Server) limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limitBody(s.maxBodySize)(next)(w, r)
+	}
+}
+
+func logRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isVerbose(w) {
+			logf(w, "%s %s\n", r.Method, r.URL.RequestURI())
+		}
+		next(w, r)
+	}
+}
+
+// require a client certificate and api key permitted to call endpoint, and
+// for the users named by the userParams path values
+func requireClientCert(endpoint string, userParams ...string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if checkClientCert(w, r, endpoint, userParams...) {
+				next(w, r)
+			}
+		}
+	}
+}
+
+func requireScanAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkScanAuth(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+func requireDebug(endpoint string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if checkDebug(w, r, endpoint) {
+				next(w, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestServer(t *testing.T, apiKey string, spamClasses []classes.SpamClass) *Server {
+	classesFile := filepath.Join(t.TempDir(), "classes.json")
+	config, err := classes.New("")
+	require.Nil(t, err)
+	config.SetClasses("alice@example.org", spamClasses)
+	require.Nil(t, config.Write(classesFile))
+	proxies, err := parseTrustedProxies(defaultTrustedProxies)
+	require.Nil(t, err)
+	var serverConfig atomic.Pointer[ServerConfig]
+	serverConfig.Store(&ServerConfig{
+		ApiKeys:        []ApiKey{{Name: "admin", Key: apiKey, Endpoints: []string{"*"}}},
+		ClientCerts:    defaultClientCerts,
+		TrustedProxies: proxies,
+		Scan:           &ScanConfig{Auth: ScanAuthNone},
+	})
+	return NewServer(&serverConfig, classesFile, nil)
+}
+
+func getServerClass(t *testing.T, server *Server, apiKey string) (int, string) {
+	req := certRequest("GET", "CN=filterctl", apiKey)
+	req.URL = httptest.NewRequest("GET", "/filterctl/class/alice@example.org/5/", nil).URL
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	result := w.Result()
+	if result.StatusCode != http.StatusOK {
+		return result.StatusCode, ""
+	}
+	var response ClassResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.NotEmpty(t, result.Header.Get("X-Request-Id"))
+	return result.StatusCode, response.Class
+}
+
+func TestIndependentServers(t *testing.T) {
+	Initialize(t)
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+
+	first := newTestServer(t, "firstkey", []classes.SpamClass{{Name: "ham", Score: 10}, {Name: "spam", Score: 999}})
+	second := newTestServer(t, "secondkey", []classes.SpamClass{{Name: "ham", Score: 1}, {Name: "spam", Score: 999}})
+
+	status, class := getServerClass(t, first, "firstkey")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "ham", class)
+
+	status, class = getServerClass(t, second, "secondkey")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "spam", class)
+
+	status, _ = getServerClass(t, first, "secondkey")
+	require.Equal(t, http.StatusUnauthorized, status)
+}
+
+func requireInternalError(t *testing.T, result *http.Response) {
+	require.Equal(t, http.StatusInternalServerError, result.StatusCode)
+	var response api.Response
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.False(t, response.Success)
+	require.Equal(t, "internal error; request id "+result.Header.Get("X-Request-Id"), response.Message)
+}
+
+func TestRecoverPanic(t *testing.T) {
+	Initialize(t)
+	server := newTestServer(t, "testkey", nil)
+	server.route("GET /test/panic", func(w http.ResponseWriter, r *http.Request) {
+		var config *ServerConfig
+		_ = config.AuditLog
+	})
+	before := internalErrors.Value("panic")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test/panic", nil))
+	requireInternalError(t, w.Result())
+	require.Equal(t, before+1, internalErrors.Value("panic"))
+}
+
+func TestEncodeError(t *testing.T) {
+	Initialize(t)
+	server := newTestServer(t, "testkey", nil)
+	server.route("GET /test/encode", func(w http.ResponseWriter, r *http.Request) {
+		succeed(w, "unencodable", map[string]float64{"score": math.Inf(1)})
+	})
+	before := internalErrors.Value("encode")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/test/encode", nil))
+	requireInternalError(t, w.Result())
+	require.Equal(t, before+1, internalErrors.Value("encode"))
+}
+
+func TestLimitBody(t *testing.T) {
+	handler := chain(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}, limitBody(16))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", strings.NewReader("short")))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 17))))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+}
+
+func TestRouteUserScope(t *testing.T) {
+	Initialize(t)
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+
+	server := newTestServer(t, "adminkey", nil)
+	config := *server.Config()
+	config.ApiKeys = []ApiKey{{Name: "alice", Key: "alicekey", Endpoints: []string{"*"}, Users: []string{"alice@example.org"}}}
+	server.config.Store(&config)
+	server.newController = func() (*api.Controller, error) {
+		return nil, fmt.Errorf("no backend")
+	}
+	status := func(method, path string) int {
+		req := certRequest(method, "CN=filterctl", "alicekey")
+		req.URL = httptest.NewRequest(method, path, nil).URL
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	// the contact being deleted is not a user; only {user} is scoped
+	require.Equal(t, http.StatusInternalServerError, status("DELETE", "/filterctl/address/alice@example.org/friends/carol@other.org/"))
+	require.Equal(t, http.StatusForbidden, status("DELETE", "/filterctl/address/bob@example.org/friends/alice@example.org/"))
+	// trace and classes routes are scoped by {address}
+	require.Equal(t, http.StatusOK, status("PUT", "/filterctl/trace/alice@example.org/"))
+	require.Equal(t, http.StatusOK, status("DELETE", "/filterctl/trace/alice@example.org/"))
+	require.Equal(t, http.StatusForbidden, status("PUT", "/filterctl/trace/bob@example.org/"))
+	require.Equal(t, http.StatusForbidden, status("GET", "/filterctl/classes/bob@example.org/"))
+}
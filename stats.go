@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/viper"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultStatsInterval = 5 * time.Minute
+
+// users tracked at once by default; recording a new user beyond the limit evicts the least recently seen
+const defaultStatsMaxUsers = 10000
+
+// upper bounds of the score histogram buckets; the last bucket counts scores above them all
+var scoreBuckets = []float64{-5, 0, 2, 4, 6, 8, 10, 12, 15, 20, 50}
+
+// persistence settings for the per-user classification stats
+//
+// MaxUsers limits the users tracked; zero means no limit.
+type StatsConfig struct {
+	File     string
+	Interval time.Duration
+	MaxUsers int
+}
+
+func newStatsConfig(v *viper.Viper) (*StatsConfig, error) {
+	config := StatsConfig{
+		File:     v.GetString("stats.file"),
+		Interval: v.GetDuration("stats.interval"),
+		MaxUsers: v.GetInt("stats.max_users"),
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("invalid stats.interval: %v", config.Interval)
+	}
+	if config.MaxUsers < 0 {
+		return nil, fmt.Errorf("invalid stats.max_users: %d", config.MaxUsers)
+	}
+	return &config, nil
+}
+
+func (c StatsConfig) String() string {
+	return fmt.Sprintf("file=%s interval=%v max_users=%d", c.File, c.Interval, c.MaxUsers)
+}
+
+// classes returned and scores seen for one user by the get_class endpoint
+//
+// ScoreCounts[i] counts scores <= ScoreBuckets[i] and above the previous
+// bound; the final element counts scores above every bound.
+type UserStats struct {
+	Count        uint64
+	Classes      map[string]uint64
+	ScoreBuckets []float64
+	ScoreCounts  []uint64
+	ScoreSum     float64
+	MinScore     float32
+	MaxScore     float32
+	First        time.Time
+	Last         time.Time
+}
+
+func newUserStats() *UserStats {
+	return &UserStats{
+		Classes:      map[string]uint64{},
+		ScoreBuckets: scoreBuckets,
+		ScoreCounts:  make([]uint64, len(scoreBuckets)+1),
+	}
+}
+
+func (s *UserStats) record(class string, score float32, now time.Time) {
+	if s.Count == 0 || score < s.MinScore {
+		s.MinScore = score
+	}
+	if s.Count == 0 || score > s.MaxScore {
+		s.MaxScore = score
+	}
+	if s.First.IsZero() {
+		s.First = now
+	}
+	s.Last = now
+	s.Count++
+	s.Classes[class]++
+	s.ScoreSum += float64(score)
+	bucket, _ := slices.BinarySearch(s.ScoreBuckets, float64(score))
+	s.ScoreCounts[bucket]++
+}
+
+func (s *UserStats) clone() UserStats {
+	c := *s
+	c.Classes = maps.Clone(s.Classes)
+	c.ScoreBuckets = slices.Clone(s.ScoreBuckets)
+	c.ScoreCounts = slices.Clone(s.ScoreCounts)
+	return c
+}
+
+type StatsResponse struct {
+	api.Response
+	Stats UserStats
+}
+
+// in-memory per-user stats, periodically saved to the stats file
+//
+// Recipients are caller supplied, so at most limit users are kept; zero
+// means no limit.  recent orders the users from most to least recently
+// recorded, so eviction does not scan the map.
+type statsStore struct {
+	mutex   sync.Mutex
+	users   map[string]*UserStats
+	recent  list.List
+	entries map[string]*list.Element
+	limit   int
+	dirty   bool
+}
+
+var classStats = statsStore{users: map[string]*UserStats{}, limit: defaultStatsMaxUsers}
+
+func (s *statsStore) Record(user, class string, score float32, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, ok := s.users[user]
+	if !ok {
+		stats = newUserStats()
+		s.users[user] = stats
+	}
+	stats.record(class, score, now)
+	s.touch(user)
+	s.trim()
+	s.dirty = true
+}
+
+// move user to the front of the recency list
+func (s *statsStore) touch(user string) {
+	if element, ok := s.entries[user]; ok {
+		s.recent.MoveToFront(element)
+		return
+	}
+	if s.entries == nil {
+		s.entries = map[string]*list.Element{}
+	}
+	s.entries[user] = s.recent.PushFront(user)
+}
+
+// remove the least recently recorded users beyond the limit
+func (s *statsStore) trim() {
+	for s.limit > 0 && len(s.users) > s.limit {
+		oldest := s.recent.Remove(s.recent.Back()).(string)
+		delete(s.entries, oldest)
+		delete(s.users, oldest)
+		s.dirty = true
+	}
+}
+
+// change the user limit, evicting the least recently recorded users beyond it
+func (s *statsStore) SetLimit(limit int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limit = limit
+	s.trim()
+}
+
+func (s *statsStore) Get(user string) (UserStats, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, ok := s.users[user]
+	if !ok {
+		return UserStats{}, false
+	}
+	return stats.clone(), true
+}
+
+// replace the stats with the contents of filename; a missing file leaves them empty
+func (s *statsStore) Load(filename string) error {
+	users := map[string]*UserStats{}
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &users)
+		if err != nil {
+			return fmt.Errorf("failed parsing %s: %v", filename, err)
+		}
+	}
+	for user, stats := range users {
+		// histograms saved with different buckets cannot be merged
+		if !slices.Equal(stats.ScoreBuckets, scoreBuckets) || len(stats.ScoreCounts) != len(scoreBuckets)+1 {
+			log.Printf("stats: discarding score histogram for %s saved with different buckets\n", user)
+			stats.ScoreBuckets = scoreBuckets
+			stats.ScoreCounts = make([]uint64, len(scoreBuckets)+1)
+		}
+		if stats.Classes == nil {
+			stats.Classes = map[string]uint64{}
+		}
+	}
+	names := sortedKeys(users)
+	slices.SortStableFunc(names, func(a, b string) int {
+		return users[a].Last.Compare(users[b].Last)
+	})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users = users
+	s.recent.Init()
+	s.entries = nil
+	for _, user := range names {
+		s.touch(user)
+	}
+	s.dirty = false
+	s.trim()
+	return nil
+}
+
+// write the stats to filename if they changed since the last save
+func (s *statsStore) Save(filename string) error {
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.users)
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed creating temp file: %v", err)
+	}
+	tempName := tempFile.Name()
+	defer os.Remove(tempName)
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempName, filename)
+	}
+	if err != nil {
+		s.mutex.Lock()
+		s.dirty = true
+		s.mutex.Unlock()
+		return fmt.Errorf("failed writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+func saveStats() {
+	filename := currentConfig().Stats.File
+	if filename == "" {
+		return
+	}
+	err := classStats.Save(filename)
+	if err != nil {
+		log.Printf("stats: %v\n", err)
+	}
+}
+
+// save the stats on the configured interval until stop is closed
+func runStatsPersistence(stop <-chan struct{}) {
+	timer := time.NewTimer(currentConfig().Stats.Interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			saveStats()
+			timer.Reset(currentConfig().Stats.Interval)
+		}
+	}
+}
+
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	address := r.PathValue("address")
+	requestString := "get stats"
+	stats, ok := classStats.Get(address)
+	if !ok {
+		fail(w, address, requestString, fmt.Sprintf("no stats for %s", address), http.StatusNotFound)
+		return
+	}
+	var response StatsResponse
+	response.User = address
+	response.Request = requestString
+	response.Success = true
+	response.Stats = stats
+	response.Message = fmt.Sprintf("%s: %d classifications", address, stats.Count)
+	succeed(w, response.Message, &response)
+}
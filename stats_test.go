@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserStats(t *testing.T) {
+	store := statsStore{users: map[string]*UserStats{}}
+	now := time.Now()
+	store.Record("alice@example.org", "ham", 1, now)
+	store.Record("alice@example.org", "ham", 2, now)
+	store.Record("alice@example.org", "spam", 99, now)
+	stats, ok := store.Get("alice@example.org")
+	require.True(t, ok)
+	require.Equal(t, uint64(3), stats.Count)
+	require.Equal(t, map[string]uint64{"ham": 2, "spam": 1}, stats.Classes)
+	require.Equal(t, float32(1), stats.MinScore)
+	require.Equal(t, float32(99), stats.MaxScore)
+	require.Equal(t, uint64(2), stats.ScoreCounts[2])
+	require.Equal(t, uint64(1), stats.ScoreCounts[len(scoreBuckets)])
+	_, ok = store.Get("bob@example.org")
+	require.False(t, ok)
+
+	filename := filepath.Join(t.TempDir(), "stats.json")
+	require.Nil(t, store.Save(filename))
+	loaded := statsStore{}
+	require.Nil(t, loaded.Load(filename))
+	reloaded, ok := loaded.Get("alice@example.org")
+	require.True(t, ok)
+	require.Equal(t, stats.Classes, reloaded.Classes)
+	require.Equal(t, stats.ScoreCounts, reloaded.ScoreCounts)
+
+	require.Nil(t, loaded.Load(filepath.Join(t.TempDir(), "missing.json")))
+	_, ok = loaded.Get("alice@example.org")
+	require.False(t, ok)
+}
+
+func TestStatsLimit(t *testing.T) {
+	store := statsStore{users: map[string]*UserStats{}, limit: 2}
+	now := time.Now()
+	store.Record("alice@example.org", "ham", 1, now)
+	store.Record("bob@example.org", "ham", 1, now.Add(time.Second))
+	store.Record("alice@example.org", "ham", 1, now.Add(2*time.Second))
+	store.Record("carol@example.org", "ham", 1, now.Add(3*time.Second))
+	require.Len(t, store.users, 2)
+	_, ok := store.Get("bob@example.org")
+	require.False(t, ok)
+	_, ok = store.Get("alice@example.org")
+	require.True(t, ok)
+	_, ok = store.Get("carol@example.org")
+	require.True(t, ok)
+
+	// a saved file larger than the limit is trimmed to the most recent users
+	store.SetLimit(0)
+	store.Record("dave@example.org", "ham", 1, now.Add(4*time.Second))
+	filename := filepath.Join(t.TempDir(), "stats.json")
+	require.Nil(t, store.Save(filename))
+	loaded := statsStore{limit: 1}
+	require.Nil(t, loaded.Load(filename))
+	require.Equal(t, []string{"dave@example.org"}, sortedKeys(loaded.users))
+
+	store.SetLimit(1)
+	require.Equal(t, []string{"dave@example.org"}, sortedKeys(store.users))
+	require.Equal(t, 1, store.recent.Len())
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	classStats = statsStore{users: map[string]*UserStats{}}
+
+	for _, score := range []string{"3", "9", "12"} {
+		req := httptest.NewRequest("GET", "/filterctl/class/alice@example.org/"+score+"/", nil)
+		result := callHandler("GET /filterctl/class/{address}/{score}/", handleGetClass, req)
+		require.Equal(t, http.StatusOK, result.StatusCode)
+	}
+
+	req := httptest.NewRequest("GET", "/filterctl/stats/alice@example.org/", nil)
+	result := callHandler("GET /filterctl/stats/{address}/", handleGetStats, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response StatsResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.Equal(t, uint64(3), response.Stats.Count)
+	require.Equal(t, map[string]uint64{"ham": 1, "probable": 1, "spam": 1}, response.Stats.Classes)
+
+	req = httptest.NewRequest("GET", "/filterctl/stats/bob@example.org/", nil)
+	result = callHandler("GET /filterctl/stats/{address}/", handleGetStats, req)
+	require.Equal(t, http.StatusNotFound, result.StatusCode)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/rspamd-classes/classes"
+	"github.com/spf13/viper"
+	"net/http"
+	"os"
+	"time"
+)
+
+var startTime = time.Now()
+
+type StatusResponse struct {
+	api.Response
+	Version        string
+	ClassesVersion string
+	ApiVersion     string
+	Started        time.Time
+	Uptime         string
+	PID            int
+	UID            int
+	GID            int
+	OpenFiles      int
+	MaxOpenFiles   uint64
+	ClassesFile    string
+	ClassesError   string `json:",omitempty"`
+	ConfigFile     string
+	CustomUsers    int
+}
+
+// count users with their own class set
+func customUsers(config *classes.SpamClasses) int {
+	count := 0
+	for user := range config.Classes {
+		if user != "default" {
+			count++
+		}
+	}
+	return count
+}
+
+func handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	requestString := "status"
+	var response StatusResponse
+	response.User = "system"
+	response.Request = requestString
+	response.Success = true
+	response.Version = Version
+	response.ClassesVersion = classes.Version
+	response.ApiVersion = api.Version
+	response.Started = startTime
+	response.Uptime = time.Since(startTime).Round(time.Second).String()
+	response.PID = os.Getpid()
+	response.UID = os.Getuid()
+	response.GID = os.Getgid()
+	openFiles, err := openFileCount()
+	if err != nil {
+		logf(w, "status: %v\n", err)
+		openFiles = -1
+	}
+	response.OpenFiles = openFiles
+	rLimit, err := fileLimit()
+	if err != nil {
+		logf(w, "status: failed getting resource limits: %v\n", err)
+	} else {
+		response.MaxOpenFiles = uint64(rLimit.Cur)
+	}
+	response.ClassesFile = requestServer(w).classesFile
+	response.ConfigFile = viper.ConfigFileUsed()
+	// an unreadable classes file is reported rather than failing the status request
+	config, err := cachedConfig(response.ClassesFile)
+	if err != nil {
+		configErrors.Inc("read")
+		response.ClassesError = err.Error()
+	} else {
+		response.CustomUsers = customUsers(config)
+	}
+	response.Message = fmt.Sprintf("%s v%s up %s", serverName, Version, response.Uptime)
+	succeed(w, response.Message, &response)
+}
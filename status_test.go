@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	Initialize(t)
+	initClassesFile(t)
+	req := httptest.NewRequest("GET", "/filterctl/status", nil)
+	result := callHandler("GET /filterctl/status", handleGetStatus, req)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var response StatusResponse
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.True(t, response.Success)
+	require.Equal(t, Version, response.Version)
+	require.Equal(t, os.Getpid(), response.PID)
+	require.Equal(t, configFile, response.ClassesFile)
+	require.Equal(t, 1, response.CustomUsers)
+	require.Greater(t, response.OpenFiles, 0)
+	require.Greater(t, response.MaxOpenFiles, uint64(0))
+	require.Empty(t, response.ClassesError)
+
+	// a corrupt classes file is reported, not fatal
+	require.Nil(t, os.WriteFile(configFile, []byte("{not json"), 0600))
+	result = callHandler("GET /filterctl/status", handleGetStatus, httptest.NewRequest("GET", "/filterctl/status", nil))
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	response = StatusResponse{}
+	require.Nil(t, json.NewDecoder(result.Body).Decode(&response))
+	require.True(t, response.Success)
+	require.NotEmpty(t, response.ClassesError)
+	require.Equal(t, 0, response.CustomUsers)
+}
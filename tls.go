@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+var defaultTrustedProxies = []string{"127.0.0.1", "::1"}
+
+// build the listener TLS config from the tls.* viper settings
+//
+// Client certificates are verified against tls.client_ca when presented;
+// connections without one are accepted so that trusted proxies may still
+// forward the X-Client-Cert-Dn header.
+func newTLSConfig() (*tls.Config, error) {
+	certFile := viper.GetString("tls.cert")
+	keyFile := viper.GetString("tls.key")
+	caFile := viper.GetString("tls.client_ca")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("tls.cert, tls.key and tls.client_ca are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading server certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading client CA: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s': %v", proxy, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %v", proxy, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(remoteAddr string, proxies []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, proxy := range proxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the client certificate DN from the TLS connection or a trusted proxy header
+//
+// Certificates are identified by common name alone, returned as CN=<name>,
+// so a subject with other RDNs such as CN=filterctl,O=example matches a
+// configured CN=filterctl.
+func clientCertDN(r *http.Request, trustedProxies []netip.Prefix) (string, int, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "CN=" + r.TLS.PeerCertificates[0].Subject.CommonName, 0, nil
+	}
+	certHeader, ok := r.Header["X-Client-Cert-Dn"]
+	if !ok {
+		return "", http.StatusUnauthorized, fmt.Errorf("missing client certificate")
+	}
+	if !isTrustedProxy(r.RemoteAddr, trustedProxies) {
+		return "", http.StatusUnauthorized, fmt.Errorf("client certificate header from untrusted peer %s", r.RemoteAddr)
+	}
+	if len(certHeader) != 1 {
+		return "", http.StatusBadRequest, fmt.Errorf("unexpected multiple cert header values: %v", certHeader)
+	}
+	return commonNameDN(certHeader[0]), 0, nil
+}
+
+// reduce a configured DN to the CN=<cn> form peers are matched by
+func configuredDN(dn string) (string, error) {
+	cn := commonNameDN(dn)
+	if !strings.HasPrefix(cn, "CN=") {
+		return "", fmt.Errorf("dn '%s' has no CN", dn)
+	}
+	return cn, nil
+}
+
+// reduce an RFC 2253 or slash separated DN to its CN; a DN without one is returned unchanged
+func commonNameDN(dn string) string {
+	for _, rdn := range strings.FieldsFunc(dn, func(c rune) bool { return c == ',' || c == '/' }) {
+		name, value, ok := strings.Cut(strings.TrimSpace(rdn), "=")
+		if ok && strings.EqualFold(name, "CN") {
+			return "CN=" + value
+		}
+	}
+	return dn
+}
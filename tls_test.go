@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+func TestClientCertDN(t *testing.T) {
+	Initialize(t)
+	proxies, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	require.Nil(t, err)
+
+	req := certRequest("GET", "CN=filterctl", "")
+	dn, _, err := clientCertDN(req, proxies)
+	require.Nil(t, err)
+	require.Equal(t, "CN=filterctl", dn)
+
+	req.RemoteAddr = "10.1.2.3:40000"
+	_, _, err = clientCertDN(req, proxies)
+	require.Nil(t, err)
+
+	req.RemoteAddr = "192.0.2.1:40000"
+	_, status, err := clientCertDN(req, proxies)
+	require.NotNil(t, err)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "filterbooks"}}},
+	}
+	dn, _, err = clientCertDN(req, proxies)
+	require.Nil(t, err)
+	require.Equal(t, "CN=filterbooks", dn)
+
+	// subjects with other RDNs match on the common name
+	req.TLS.PeerCertificates[0].Subject = pkix.Name{CommonName: "filterbooks", Organization: []string{"example"}}
+	dn, _, err = clientCertDN(req, proxies)
+	require.Nil(t, err)
+	require.Equal(t, "CN=filterbooks", dn)
+	req.TLS = nil
+	req.RemoteAddr = "127.0.0.1:40000"
+	for _, header := range []string{"CN=filterctl,O=example", "O=example, CN=filterctl", "/C=US/O=example/CN=filterctl"} {
+		req.Header.Set("X-Client-Cert-Dn", header)
+		dn, _, err = clientCertDN(req, proxies)
+		require.Nil(t, err)
+		require.Equal(t, "CN=filterctl", dn, header)
+	}
+}
+
+func TestConfiguredDN(t *testing.T) {
+	v := viper.New()
+	setDefaults(v)
+	v.Set("scan.auth", ScanAuthCert)
+	v.Set("scan.client_dn", "CN=rspamd,O=example")
+	v.Set("client_certs", []map[string]any{{"dn": "O=example/cn=filterctl", "endpoints": []string{"*"}}})
+	config, err := newServerConfig(v)
+	require.Nil(t, err)
+	require.Equal(t, "CN=rspamd", config.Scan.ClientDN)
+	_, ok := config.ClientCert("CN=filterctl")
+	require.True(t, ok)
+
+	v.Set("client_certs", []map[string]any{{"dn": "O=example", "endpoints": []string{"*"}}})
+	_, err = newServerConfig(v)
+	require.NotNil(t, err)
+	v.Set("client_certs", nil)
+	v.Set("scan.client_dn", "rspamd")
+	_, err = newScanConfig(v)
+	require.NotNil(t, err)
+}
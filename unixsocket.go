@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultUnixSocketMode = 0660
+
+// a unix domain socket listener, served alongside TCP without TLS
+//
+// Owner and Group are names or numeric ids; empty leaves the socket owned by
+// the daemon user.  MaxConnections caps socket connections separately from
+// http.max_connections, so local clients are not starved by TCP clients.
+type UnixSocketConfig struct {
+	Path           string
+	Owner          string
+	Group          string
+	Mode           os.FileMode
+	MaxConnections int
+}
+
+func newUnixSocketConfig(v *viper.Viper) (*UnixSocketConfig, error) {
+	config := UnixSocketConfig{
+		Path:           v.GetString("unix_socket.path"),
+		Owner:          v.GetString("unix_socket.owner"),
+		Group:          v.GetString("unix_socket.group"),
+		MaxConnections: v.GetInt("unix_socket.max_connections"),
+	}
+	// yaml reads an unquoted 0660 as an integer and a quoted one as a string
+	switch mode := v.Get("unix_socket.mode").(type) {
+	case int:
+		config.Mode = os.FileMode(mode)
+	case string:
+		value, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unix_socket.mode: '%s'", mode)
+		}
+		config.Mode = os.FileMode(value)
+	default:
+		return nil, fmt.Errorf("invalid unix_socket.mode: %v", mode)
+	}
+	if config.Mode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("invalid unix_socket.mode: %o", config.Mode)
+	}
+	if config.MaxConnections < 0 {
+		return nil, fmt.Errorf("invalid unix_socket.max_connections: %d", config.MaxConnections)
+	}
+	return &config, nil
+}
+
+func (c UnixSocketConfig) String() string {
+	return fmt.Sprintf("path=%s owner=%s group=%s mode=%04o max_connections=%d", c.Path, c.Owner, c.Group, c.Mode, c.MaxConnections)
+}
+
+// create the socket, replacing one left by an unclean exit, and apply its owner and mode
+//
+// Requests on the socket are authorized by peer credentials, so it is not
+// created where they cannot be read.
+func listenUnix(config *UnixSocketConfig) (net.Listener, error) {
+	if !peerCredSupported {
+		return nil, fmt.Errorf("unix socket peer credentials are not supported on %s", runtime.GOOS)
+	}
+	info, err := os.Lstat(config.Path)
+	if err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", config.Path)
+		}
+		err = os.Remove(config.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	uid, gid := -1, -1
+	if config.Owner != "" {
+		uid, err = lookupUid(config.Owner)
+		if err != nil {
+			return nil, fmt.Errorf("unix_socket.owner: %v", err)
+		}
+	}
+	if config.Group != "" {
+		gid, err = lookupGid(config.Group)
+		if err != nil {
+			return nil, fmt.Errorf("unix_socket.group: %v", err)
+		}
+	}
+	// create the socket owner-only, then widen it once the group is set; the
+	// umask is process wide, so this runs before any listener serves requests
+	umask := unix.Umask(0177)
+	listener, err := net.Listen("unix", config.Path)
+	unix.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if uid >= 0 || gid >= 0 {
+		err = os.Chown(config.Path, uid, gid)
+	}
+	if err == nil {
+		err = os.Chmod(config.Path, config.Mode)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// return the uid of a user name or numeric uid
+func lookupUid(name string) (int, error) {
+	id, err := strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// return the gid of a group name or numeric gid
+func lookupGid(name string) (int, error) {
+	id, err := strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// credentials of the process at the other end of a unix socket connection
+type PeerCred struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+func (c PeerCred) String() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", c.Uid, c.Gid, c.Pid)
+}
+
+// endpoints that may be called by a unix socket peer
+//
+// User is a user name or numeric uid.  Endpoints uses the same syntax as
+// ClientCertPolicy, and Users restricts the mail users the peer may act on
+// as it does for ApiKey.  An X-Api-Key sent by the peer is checked as well,
+// and RequireApiKey makes one mandatory.
+type PeerPolicy struct {
+	User          string
+	Endpoints     []string
+	Users         []string
+	RequireApiKey bool `mapstructure:"require_api_key"`
+	uid           uint32
+}
+
+func (p *PeerPolicy) Permits(endpoint, method string) bool {
+	return permits(p.Endpoints, endpoint, method)
+}
+
+func (p *PeerPolicy) PermitsUser(user string) bool {
+	return len(p.Users) == 0 || slices.Contains(p.Users, user)
+}
+
+func (p PeerPolicy) String() string {
+	return fmt.Sprintf("%s:[%s] users=[%s] require_api_key=%v", p.User, strings.Join(p.Endpoints, ","), strings.Join(p.Users, ","), p.RequireApiKey)
+}
+
+func newPeerPolicies(v *viper.Viper) ([]PeerPolicy, error) {
+	var policies []PeerPolicy
+	err := v.UnmarshalKey("unix_socket.peers", &policies)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing unix_socket.peers: %v", err)
+	}
+	for i := range policies {
+		policy := &policies[i]
+		if policy.User == "" {
+			return nil, fmt.Errorf("unix_socket.peers: missing user")
+		}
+		if len(policy.Endpoints) == 0 {
+			return nil, fmt.Errorf("unix_socket.peers: %s has no endpoints", policy.User)
+		}
+		uid, err := lookupUid(policy.User)
+		if err != nil {
+			return nil, fmt.Errorf("unix_socket.peers: %v", err)
+		}
+		policy.uid = uint32(uid)
+	}
+	return policies, nil
+}
+
+// return the policy for a peer uid
+func (c *ServerConfig) Peer(uid uint32) (*PeerPolicy, bool) {
+	for i := range c.Peers {
+		if c.Peers[i].uid == uid {
+			return &c.Peers[i], true
+		}
+	}
+	return nil, false
+}
+
+type peerCredKey struct{}
+
+// attach the peer credentials of unix socket connections to their requests' context
+func peerConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if lc, ok := conn.(*limitConn); ok {
+		conn = lc.Conn
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := peerCred(unixConn)
+	if err != nil {
+		log.Printf("unix socket: failed reading peer credentials: %v\n", err)
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+func requestPeer(r *http.Request) (*PeerCred, bool) {
+	cred, ok := r.Context().Value(peerCredKey{}).(*PeerCred)
+	return cred, ok
+}
+
+// authorize a unix socket request by its peer uid, and by api key if present or required
+func checkPeer(w http.ResponseWriter, r *http.Request, endpoint string, peer *PeerCred, userParams []string) bool {
+	rw, hasState := requestState(w)
+	if hasState {
+		rw.dn = "peer " + peer.String()
+	}
+	policy, ok := requestConfig(w).Peer(peer.Uid)
+	if !ok {
+		systemFail(w, endpoint, fmt.Sprintf("unexpected unix socket peer: %s", peer), http.StatusUnauthorized)
+		return false
+	}
+	if !policy.Permits(endpoint, r.Method) {
+		fail(w, "system", endpoint, fmt.Sprintf("peer '%s' not permitted to call %s", policy.User, endpoint), http.StatusForbidden)
+		return false
+	}
+	for _, name := range userParams {
+		user := r.PathValue(name)
+		if user != "" && !policy.PermitsUser(user) {
+			fail(w, user, endpoint, fmt.Sprintf("peer '%s' not permitted for user %s", policy.User, user), http.StatusForbidden)
+			return false
+		}
+	}
+	if hasState {
+		rw.peer = policy
+	}
+	_, hasKey := r.Header["X-Api-Key"]
+	if !hasKey && !policy.RequireApiKey {
+		return true
+	}
+	key, ok := checkApiKey(w, r, endpoint)
+	if !ok {
+		return false
+	}
+	return checkApiKeyScope(w, r, endpoint, key, userParams)
+}
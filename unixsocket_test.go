@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUnixSocketConfig(t *testing.T) {
+	v := viper.New()
+	setDefaults(v)
+	config, err := newUnixSocketConfig(v)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0660), config.Mode)
+	require.Equal(t, 32, config.MaxConnections)
+
+	v.Set("unix_socket.mode", "0600")
+	config, err = newUnixSocketConfig(v)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), config.Mode)
+
+	v.Set("unix_socket.mode", "rw-rw----")
+	_, err = newUnixSocketConfig(v)
+	require.NotNil(t, err)
+	v.Set("unix_socket.mode", 04755)
+	_, err = newUnixSocketConfig(v)
+	require.NotNil(t, err)
+	v.Set("unix_socket.mode", "0600")
+	v.Set("unix_socket.max_connections", -1)
+	_, err = newUnixSocketConfig(v)
+	require.NotNil(t, err)
+}
+
+func TestPeerPolicies(t *testing.T) {
+	v := viper.New()
+	v.Set("unix_socket.peers", []map[string]any{{"user": "1234", "endpoints": []string{"GET"}, "require_api_key": true}})
+	policies, err := newPeerPolicies(v)
+	require.Nil(t, err)
+	require.Len(t, policies, 1)
+	require.Equal(t, uint32(1234), policies[0].uid)
+	require.True(t, policies[0].RequireApiKey)
+	require.True(t, policies[0].PermitsUser("bob@example.org"))
+
+	v.Set("unix_socket.peers", []map[string]any{{"user": "1234"}})
+	_, err = newPeerPolicies(v)
+	require.NotNil(t, err)
+}
+
+func TestUnixSocketPeer(t *testing.T) {
+	if !peerCredSupported {
+		t.Skip("peer credentials unsupported")
+	}
+	insecure := InsecureSkipClientCertificateValidation
+	InsecureSkipClientCertificateValidation = false
+	defer func() { InsecureSkipClientCertificateValidation = insecure }()
+
+	uid := strconv.Itoa(os.Getuid())
+	v := viper.New()
+	v.Set("unix_socket.peers", []map[string]any{{"user": uid, "endpoints": []string{"get_log_level", "get_stats"}, "users": []string{"peer@example.org"}}})
+	peers, err := newPeerPolicies(v)
+	require.Nil(t, err)
+	var serverConfig atomic.Pointer[ServerConfig]
+	serverConfig.Store(&ServerConfig{
+		ApiKeys:     []ApiKey{{Name: "admin", Key: "peer-test-key", Endpoints: []string{"*"}}},
+		ClientCerts: defaultClientCerts,
+		Scan:        &ScanConfig{Auth: ScanAuthNone},
+		Peers:       peers,
+	})
+
+	path := filepath.Join(t.TempDir(), "filterctld.sock")
+	listener, err := listenUnix(&UnixSocketConfig{Path: path, Mode: 0600})
+	require.Nil(t, err)
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	wide, err := listenUnix(&UnixSocketConfig{Path: filepath.Join(t.TempDir(), "wide.sock"), Mode: 0666})
+	require.Nil(t, err)
+	info, err = os.Stat(wide.Addr().String())
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0666), info.Mode().Perm())
+	wide.Close()
+
+	server := http.Server{Handler: NewServer(&serverConfig, configFile, nil), ConnContext: peerConnContext}
+	go server.Serve(listener)
+	defer server.Close()
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	get := func(url, apiKey string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		require.Nil(t, err)
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		response, err := client.Do(req)
+		require.Nil(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// the peer uid alone authorizes its endpoints
+	require.Equal(t, http.StatusOK, get("http://unix/filterctl/loglevel/", ""))
+	require.Equal(t, http.StatusForbidden, get("http://unix/filterctl/status", ""))
+	// the peer is limited to its users
+	require.Equal(t, http.StatusNotFound, get("http://unix/filterctl/stats/peer@example.org/", ""))
+	require.Equal(t, http.StatusForbidden, get("http://unix/filterctl/stats/bob@example.org/", ""))
+	rw := &requestWriter{ResponseWriter: httptest.NewRecorder(), peer: &peers[0]}
+	require.True(t, checkUser(rw, "add_book", "peer@example.org"))
+	require.False(t, checkUser(rw, "add_book", "bob@example.org"))
+	// a key sent by the peer must still match
+	require.Equal(t, http.StatusUnauthorized, get("http://unix/filterctl/loglevel/", "wrong-key"))
+
+	peers[0].RequireApiKey = true
+	require.Equal(t, http.StatusBadRequest, get("http://unix/filterctl/loglevel/", ""))
+	require.Equal(t, http.StatusOK, get("http://unix/filterctl/loglevel/", "peer-test-key"))
+
+	serverConfig.Store(&ServerConfig{ClientCerts: defaultClientCerts, Scan: &ScanConfig{Auth: ScanAuthNone}})
+	require.Equal(t, http.StatusUnauthorized, get("http://unix/filterctl/loglevel/", "peer-test-key"))
+
+	// a stale socket is replaced, anything else is left alone
+	server.Close()
+	_, err = listenUnix(&UnixSocketConfig{Path: path, Mode: 0600})
+	require.Nil(t, err)
+	regular := filepath.Join(t.TempDir(), "regular")
+	require.Nil(t, os.WriteFile(regular, nil, 0600))
+	_, err = listenUnix(&UnixSocketConfig{Path: regular, Mode: 0600})
+	require.NotNil(t, err)
+}